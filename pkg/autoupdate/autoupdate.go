@@ -1,12 +1,15 @@
 package autoupdate
 
 import (
-	"log"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/robodone/robosla-common/pkg/logging"
 )
 
+var logger = logging.For("autoupdate")
+
 var (
 	updatesMu            sync.Mutex
 	updatesDisabledDepth = 0
@@ -17,7 +20,7 @@ func DisableUpdates() {
 	updatesDisabledDepth++
 	depth := updatesDisabledDepth
 	updatesMu.Unlock()
-	log.Printf("Disabled autoupdates, depth: %d", depth)
+	logger.Info("Disabled autoupdates", "depth", depth)
 }
 
 func EnableUpdates() {
@@ -27,7 +30,7 @@ func EnableUpdates() {
 	}
 	depth := updatesDisabledDepth
 	updatesMu.Unlock()
-	log.Printf("EnableUpdates, new depth: %d", depth)
+	logger.Info("Enabled autoupdates", "depth", depth)
 }
 
 func areUpdatesEnabled() bool {
@@ -44,10 +47,10 @@ func Run(manifestURL, version string, initialDelay, delay time.Duration) {
 	time.Sleep(initialDelay)
 	for {
 		if areUpdatesEnabled() {
-			log.Printf("autoupdate.Run: updates are enabled")
+			logger.Debug("autoupdate.Run: updates are enabled")
 			needsRestart, err := UpdateCurrentBinaryIfNeeded(manifestURL, version)
 			if err != nil {
-				log.Printf("UpdateCurrentBinaryIfNeeded failed: %v", err)
+				logger.Error("UpdateCurrentBinaryIfNeeded failed", "err", err)
 			}
 			if needsRestart {
 				break
@@ -60,6 +63,6 @@ func Run(manifestURL, version string, initialDelay, delay time.Duration) {
 		time.Sleep(time.Second)
 	}
 	// Exit, just to be restarted by systemd.
-	log.Printf("New version downloaded. Restarting to start it")
+	logger.Info("New version downloaded. Restarting to start it")
 	os.Exit(0)
 }
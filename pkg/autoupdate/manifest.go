@@ -5,7 +5,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -115,7 +114,7 @@ func FetchAndParseManifest(manifestURL string) (*Manifest, error) {
 			// Definitely not good
 			return nil, fmt.Errorf("HTTP error while fetching a manifest from %q: %s %d", manifestURL, resp.Status, resp.StatusCode)
 		}
-		log.Printf("unexpected HTTP status: %s %d. Trying to parse the manifest anyway.", resp.Status, resp.StatusCode)
+		logger.Warn("Unexpected HTTP status. Trying to parse the manifest anyway", "status", resp.Status)
 	}
 	var res Manifest
 	if err := json.Unmarshal(body, &res); err != nil {
@@ -147,7 +146,7 @@ func UpdateCurrentBinaryIfNeeded(manifestURL, version string) (needsRestart bool
 	if err != nil {
 		return false, fmt.Errorf("failed to get the path to the currently running executable: %v", err)
 	}
-	log.Printf("Current executable path: %s\n", curBinaryPath)
+	logger.Info("Updating the current executable", "path", curBinaryPath)
 	newBinaryPath := curBinaryPath + ".new"
 	// Save the new binary.
 	if err := ioutil.WriteFile(newBinaryPath, binary, 0755); err != nil {
@@ -0,0 +1,208 @@
+package device_api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Identity is the result of a successful authentication.
+type Identity struct {
+	DeviceName string
+	// When the credentials expire. Zero means never.
+	Expires time.Time
+}
+
+func (id *Identity) expired(now time.Time) bool {
+	return !id.Expires.IsZero() && now.After(id.Expires)
+}
+
+// Authenticator verifies the token sent by a device in hello.
+type Authenticator interface {
+	Authenticate(token string) (*Identity, error)
+}
+
+// TokenRotator is implemented by authenticators which can issue a fresh token
+// for an already authenticated device.
+type TokenRotator interface {
+	Rotate(id *Identity) (token string, err error)
+}
+
+// StaticTokens maps tokens to device names. It's intended for tests.
+type StaticTokens map[string]string
+
+func (st StaticTokens) Authenticate(token string) (*Identity, error) {
+	deviceName, ok := st[token]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	return &Identity{DeviceName: deviceName}, nil
+}
+
+// HMACAuthenticator issues and verifies expiring device tokens signed with a secret key.
+// A token looks like <base64(device name)>.<expiration unix time>.<base64(HMAC-SHA256)>.
+type HMACAuthenticator struct {
+	key []byte
+	ttl time.Duration
+	now func() time.Time
+}
+
+// MinHMACKeySize is the minimum size of the key of HMACAuthenticator: the size of SHA-256.
+const MinHMACKeySize = sha256.Size
+
+// NewHMACAuthenticator returns an authenticator with the secret key, which must be
+// at least MinHMACKeySize bytes long. The key is copied.
+func NewHMACAuthenticator(key []byte, ttl time.Duration) (*HMACAuthenticator, error) {
+	if len(key) < MinHMACKeySize {
+		return nil, fmt.Errorf("the key is too short: %d bytes, want at least %d", len(key), MinHMACKeySize)
+	}
+	return &HMACAuthenticator{key: append([]byte(nil), key...), ttl: ttl, now: time.Now}, nil
+}
+
+func (a *HMACAuthenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new token for the device.
+func (a *HMACAuthenticator) Issue(deviceName string) (string, error) {
+	if deviceName == "" {
+		return "", errors.New("device name is empty")
+	}
+	expires := a.now().Add(a.ttl).Unix()
+	payload := base64.RawURLEncoding.EncodeToString([]byte(deviceName)) + "." + strconv.FormatInt(expires, 10)
+	return payload + "." + a.sign(payload), nil
+}
+
+func (a *HMACAuthenticator) Authenticate(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(a.sign(payload)), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+	deviceName, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	id := &Identity{DeviceName: string(deviceName), Expires: time.Unix(expires, 0)}
+	if id.expired(a.now()) {
+		return nil, ErrTokenExpired
+	}
+	return id, nil
+}
+
+func (a *HMACAuthenticator) Rotate(id *Identity) (string, error) {
+	return a.Issue(id.DeviceName)
+}
+
+// SetAuthenticator makes the server verify the cookie sent in hello with a, before calling Impl.Hello.
+func (srv *Server) SetAuthenticator(a Authenticator) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.auth = a
+}
+
+// Identity returns the identity of the authenticated device, or nil.
+func (srv *Server) Identity() *Identity {
+	return srv.Session().Identity
+}
+
+// checkAuth returns a user-facing error message, if the command can't be executed
+// by the connection in its current state.
+func (srv *Server) checkAuth(cmd string) string {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	switch cmd {
+	case "hello", "register-device", "pair":
+		return ""
+	}
+	if srv.session == nil {
+		return fmt.Sprintf("not authenticated: send hello before %q", cmd)
+	}
+	if srv.session.expired(time.Now()) {
+		srv.session = nil
+		return "authentication expired: send hello with a fresh token"
+	}
+	return ""
+}
+
+// authenticate verifies the token, if the server has an authenticator.
+// It returns a nil identity when there's no authenticator.
+func (srv *Server) authenticate(token string) (*Identity, error) {
+	srv.mu.Lock()
+	a := srv.auth
+	srv.mu.Unlock()
+	if a == nil {
+		return nil, nil
+	}
+	return a.Authenticate(token)
+}
+
+// rotateToken issues a fresh token for the authenticated device.
+func (srv *Server) rotateToken(resp *Response) error {
+	srv.mu.Lock()
+	a := srv.auth
+	sess := srv.sessionLocked()
+	srv.mu.Unlock()
+	rotator, ok := a.(TokenRotator)
+	id := sess.Identity
+	if !ok || id == nil {
+		return errors.New("token rotation is not supported")
+	}
+	token, err := rotator.Rotate(id)
+	if err != nil {
+		return err
+	}
+	newID, err := a.Authenticate(token)
+	if err != nil {
+		return fmt.Errorf("failed to verify the rotated token: %v", err)
+	}
+	srv.mu.Lock()
+	if srv.session != nil {
+		srv.session.Identity = newID
+	}
+	srv.mu.Unlock()
+	resp.Login = &Login{Cookie: token, DeviceName: newID.DeviceName}
+	return nil
+}
+
+// RotateToken asks the server for a fresh token for the current session. The old token
+// keeps working until it expires.
+func (c *Client) RotateToken() (string, error) {
+	sub, err := c.nd.SubValue("login.cookie")
+	if err != nil {
+		return "", fmt.Errorf("failed to subscribe for login/cookie: %v", err)
+	}
+	defer sub.Unsub()
+	// Skip the current value of the cookie, if any.
+	c.nd.Flush()
+	lastValue(sub)
+	if err := send(c.conn, &Request{Cmd: "rotate-token"}); err != nil {
+		return "", fmt.Errorf("failed to send rotate-token: %v", err)
+	}
+	select {
+	case v := <-sub.C():
+		token, _ := v.(string)
+		return token, nil
+	case <-time.After(60 * time.Second):
+		return "", errors.New("RotateToken: timed out")
+	}
+}
@@ -0,0 +1,95 @@
+package device_api
+
+import (
+	"fmt"
+	"sync"
+)
+
+// BinaryKindUser is the first kind of binary messages available to applications.
+// Smaller kinds are reserved for device_api, like camera frames.
+const BinaryKindUser = 128
+
+// BinaryHandler handles a binary message from the server. The payload does not include the kind byte,
+// and it's only valid until the handler returns.
+type BinaryHandler func(payload []byte) error
+
+// ServerBinaryHandler handles a binary message from the device, like BinaryHandler.
+type ServerBinaryHandler func(sess *Session, payload []byte) error
+
+func checkUserBinaryKind(kind byte) error {
+	if kind < BinaryKindUser {
+		return fmt.Errorf("binary message kind %d is reserved, use kinds starting from %d", kind, BinaryKindUser)
+	}
+	return nil
+}
+
+func encodeBinary(kind byte, payload []byte) []byte {
+	res := make([]byte, 1+len(payload))
+	res[0] = kind
+	copy(res[1:], payload)
+	return res
+}
+
+// binaryHandlers routes binary messages by their first byte.
+type binaryHandlers struct {
+	mu sync.Mutex
+	m  map[byte]interface{}
+}
+
+func (bh *binaryHandlers) set(kind byte, h interface{}) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	if bh.m == nil {
+		bh.m = make(map[byte]interface{})
+	}
+	bh.m[kind] = h
+}
+
+// get splits the message into the handler and the payload.
+func (bh *binaryHandlers) get(data []byte) (h interface{}, payload []byte, err error) {
+	if len(data) == 0 {
+		return nil, nil, fmt.Errorf("empty binary message")
+	}
+	bh.mu.Lock()
+	h, ok := bh.m[data[0]]
+	bh.mu.Unlock()
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown binary message kind %d", data[0])
+	}
+	return h, data[1:], nil
+}
+
+// HandleBinary registers the handler for binary messages of the kind, which must be at least BinaryKindUser.
+func (c *Client) HandleBinary(kind byte, h BinaryHandler) error {
+	if err := checkUserBinaryKind(kind); err != nil {
+		return err
+	}
+	c.binary.set(kind, h)
+	return nil
+}
+
+// SendBinary sends the payload as a binary message of the kind, which must be at least BinaryKindUser.
+func (c *Client) SendBinary(kind byte, payload []byte) error {
+	if err := checkUserBinaryKind(kind); err != nil {
+		return err
+	}
+	return c.conn.SendBinary(encodeBinary(kind, payload))
+}
+
+// HandleBinary registers the handler for binary messages of the kind, which must be at least BinaryKindUser.
+// Binary messages from unauthenticated connections are dropped.
+func (srv *Server) HandleBinary(kind byte, h ServerBinaryHandler) error {
+	if err := checkUserBinaryKind(kind); err != nil {
+		return err
+	}
+	srv.binary.set(kind, h)
+	return nil
+}
+
+// SendBinary sends the payload as a binary message of the kind, which must be at least BinaryKindUser.
+func (srv *Server) SendBinary(kind byte, payload []byte) error {
+	if err := checkUserBinaryKind(kind); err != nil {
+		return err
+	}
+	return srv.conn.SendBinary(encodeBinary(kind, payload))
+}
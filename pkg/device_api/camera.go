@@ -0,0 +1,132 @@
+package device_api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The first byte of a binary message defines its kind.
+const binaryKindCameraFrame = 1
+
+const maxCameraFrameHeaderField = 255
+
+var ErrNotCameraFrame = errors.New("not a camera frame")
+
+// CameraFrame is a single image from one of the printer cameras. Camera frames are sent
+// as binary WebSocket messages, so they don't inflate the JSON state.
+type CameraFrame struct {
+	Camera      string
+	TS          time.Time
+	ContentType string
+	Data        []byte
+}
+
+// EncodeCameraFrame serializes a camera frame into a binary message:
+//
+//	kind (1 byte) | len(camera) (1 byte) | camera | unix nanos (8 bytes, big endian) |
+//	len(contentType) (1 byte) | contentType | data
+func EncodeCameraFrame(frame *CameraFrame) ([]byte, error) {
+	if len(frame.Camera) > maxCameraFrameHeaderField {
+		return nil, fmt.Errorf("camera name is too long: %d bytes", len(frame.Camera))
+	}
+	if len(frame.ContentType) > maxCameraFrameHeaderField {
+		return nil, fmt.Errorf("content type is too long: %d bytes", len(frame.ContentType))
+	}
+	res := make([]byte, 0, 1+1+len(frame.Camera)+8+1+len(frame.ContentType)+len(frame.Data))
+	res = append(res, binaryKindCameraFrame, byte(len(frame.Camera)))
+	res = append(res, frame.Camera...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(frame.TS.UnixNano()))
+	res = append(res, ts[:]...)
+	res = append(res, byte(len(frame.ContentType)))
+	res = append(res, frame.ContentType...)
+	res = append(res, frame.Data...)
+	return res, nil
+}
+
+// DecodeCameraFrame parses a binary message created by EncodeCameraFrame.
+// The returned frame references data.
+func DecodeCameraFrame(data []byte) (*CameraFrame, error) {
+	if len(data) == 0 || data[0] != binaryKindCameraFrame {
+		return nil, ErrNotCameraFrame
+	}
+	return decodeCameraFramePayload(data[1:])
+}
+
+// decodeCameraFramePayload parses a camera frame without the kind byte.
+func decodeCameraFramePayload(rest []byte) (*CameraFrame, error) {
+	camera, rest, err := readShortString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read camera name: %v", err)
+	}
+	if len(rest) < 8 {
+		return nil, errors.New("failed to read timestamp: message is too short")
+	}
+	ts := int64(binary.BigEndian.Uint64(rest[:8]))
+	rest = rest[8:]
+	contentType, rest, err := readShortString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content type: %v", err)
+	}
+	return &CameraFrame{
+		Camera:      camera,
+		TS:          time.Unix(0, ts),
+		ContentType: contentType,
+		Data:        rest,
+	}, nil
+}
+
+func readShortString(data []byte) (string, []byte, error) {
+	if len(data) < 1 {
+		return "", nil, errors.New("message is too short")
+	}
+	n := int(data[0])
+	if len(data) < 1+n {
+		return "", nil, errors.New("message is too short")
+	}
+	return string(data[1 : 1+n]), data[1+n:], nil
+}
+
+// FrameStore keeps the latest frame per camera. It's safe for concurrent use.
+type FrameStore struct {
+	mu     sync.Mutex
+	frames map[string]*CameraFrame
+}
+
+func NewFrameStore() *FrameStore {
+	return &FrameStore{frames: make(map[string]*CameraFrame)}
+}
+
+// Put saves the frame, unless a newer frame for the same camera is already stored.
+func (fs *FrameStore) Put(frame *CameraFrame) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if prev, ok := fs.frames[frame.Camera]; ok && prev.TS.After(frame.TS) {
+		return
+	}
+	fs.frames[frame.Camera] = frame
+}
+
+// Latest returns the latest frame received from the camera. The frame must not be modified.
+func (fs *FrameStore) Latest(camera string) (*CameraFrame, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	frame, ok := fs.frames[camera]
+	return frame, ok
+}
+
+// Cameras returns the sorted names of the cameras with at least one frame.
+func (fs *FrameStore) Cameras() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	var res []string
+	for name := range fs.frames {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
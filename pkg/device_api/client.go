@@ -1,22 +1,37 @@
 package device_api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/robodone/robosla-common/pkg/job"
 	"github.com/robodone/robosla-common/pkg/pubsub"
 )
 
 type Client struct {
 	conn      Conn
 	nd        *pubsub.Node
+	frames    *FrameStore
 	mu        sync.Mutex
 	isStopped bool
+	handlers  map[string]ackHandler
+	commands  chan *Command
 	stopped   chan bool
+
+	agent *AgentInfo
+	// The protocol version negotiated in Hello. Zero before Hello.
+	protocolVersion int
+	// The capabilities of the server, received in Hello.
+	serverCaps []string
+	binary     binaryHandlers
+	offline    *OfflineQueue
+	flushing   bool
+	// The messages from the offline queue waiting for an ack, by ID.
+	uplinkAcks map[string]chan bool
 }
 
 // This channel will be closed, when the client is stopped.
@@ -28,11 +43,16 @@ func (c *Client) Stopped() <-chan bool {
 
 func NewClient(conn Conn, nd *pubsub.Node) *Client {
 	c := &Client{
-		conn:    conn,
-		nd:      nd,
-		stopped: make(chan bool),
+		conn:     conn,
+		nd:       nd,
+		frames:   NewFrameStore(),
+		commands: make(chan *Command, maxPendingCommands),
+		stopped:  make(chan bool),
 	}
+	c.binary.set(binaryKindCameraFrame, BinaryHandler(c.handleCameraFrame))
+	c.binary.set(binaryKindFileChunk, BinaryHandler(c.handleFileChunk))
 	go c.run()
+	go c.runCommands()
 	return c
 }
 
@@ -46,19 +66,62 @@ func (c *Client) run() {
 				c.Stop()
 				return
 			}
+			if msg.Type == websocket.BinaryMessage {
+				c.handleBinary(msg.Data)
+				continue
+			}
 			if msg.Type != websocket.TextMessage {
-				log.Printf("Unexpected message type %d from server. Skipping the message", msg.Type)
+				logger.Warn("Unexpected message type from server. Skipping the message", "type", msg.Type)
 				continue
 			}
-			log.Printf("Server reply received: %s", string(msg.Data))
-			err := c.nd.Pub(string(msg.Data))
-			if err != nil {
-				log.Printf("Error: failed to publish server updates: %v", err)
+			logger.Debug("Server reply received", "msg", string(msg.Data))
+			// The message is decoded once, and published as is. Only commands, which are not
+			// a part of the state, are decoded into a Response.
+			var m map[string]interface{}
+			if err := json.Unmarshal(msg.Data, &m); err != nil {
+				logger.Error("Failed to publish server updates", "err", err)
+				continue
+			}
+			if _, ok := m["command"]; ok {
+				var resp Response
+				if err := json.Unmarshal(msg.Data, &resp); err != nil {
+					logger.Warn("Malformed command from server. Skipping the message", "err", err)
+					continue
+				}
+				c.queueCommand(resp.Command)
+				continue
+			}
+			if ack, ok := m["ack"].(map[string]interface{}); ok {
+				id, _ := ack["id"].(string)
+				c.handleUplinkAck(id)
+			}
+			if err := c.nd.PubMap(m); err != nil {
+				logger.Error("Failed to publish server updates", "err", err)
 			}
 		}
 	}
 }
 
+func (c *Client) handleBinary(data []byte) {
+	h, payload, err := c.binary.get(data)
+	if err != nil {
+		logger.Warn("Failed to handle a binary message from server. Skipping the message", "err", err)
+		return
+	}
+	if err := h.(BinaryHandler)(payload); err != nil {
+		logger.Warn("Failed to handle a binary message from server", "kind", data[0], "err", err)
+	}
+}
+
+func (c *Client) handleCameraFrame(payload []byte) error {
+	frame, err := decodeCameraFramePayload(payload)
+	if err != nil {
+		return err
+	}
+	c.frames.Put(frame)
+	return nil
+}
+
 func (c *Client) Stop() error {
 	// Client does not own the connection.
 	c.mu.Lock()
@@ -98,19 +161,54 @@ func (c *Client) RegisterDevice(userCookie string) (deviceCookie string, err err
 }
 
 func (c *Client) sendHello(cookie, jobName string) error {
+	c.mu.Lock()
+	agent := c.agent
+	c.mu.Unlock()
 	return send(c.conn, &Request{
-		Cmd:     "hello",
-		Cookie:  cookie,
-		JobName: jobName,
+		Cmd:             "hello",
+		Cookie:          cookie,
+		JobName:         jobName,
+		ProtocolVersion: ProtocolVersion,
+		Agent:           agent,
 	})
 }
 
+// SetAgentInfo sets the info about the agent sent in Hello. If it's not set, the server
+// can't know which features the agent supports, and HasCapability is always false.
+func (c *Client) SetAgentInfo(agent *AgentInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.agent = agent
+}
+
+// lastValue returns the last value received by the sub so far, if any.
+func lastValue(vs *pubsub.ValueSub) (val interface{}, ok bool) {
+	for {
+		select {
+		case v := <-vs.C():
+			val, ok = v, true
+		default:
+			return val, ok
+		}
+	}
+}
+
 func (c *Client) Hello(cookie, jobName string) (machineName string, err error) {
 	sub, err := c.SubString("login.deviceName")
 	if err != nil {
 		return "", fmt.Errorf("failed to subscribe for login/deviceName: %v", err)
 	}
 	defer sub.Unsub()
+	versionSub, err := c.nd.SubValue("login.protocolVersion")
+	if err != nil {
+		return "", fmt.Errorf("failed to subscribe for login/protocolVersion: %v", err)
+	}
+	defer versionSub.Unsub()
+	capsSub, err := c.nd.SubValue("login.capabilities")
+	if err != nil {
+		return "", fmt.Errorf("failed to subscribe for login/capabilities: %v", err)
+	}
+	defer capsSub.Unsub()
 	if err := c.sendHello(cookie, jobName); err != nil {
 		return "", fmt.Errorf("failed to send hello: %v", err)
 	}
@@ -121,16 +219,130 @@ func (c *Client) Hello(cookie, jobName string) (machineName string, err error) {
 		// TODO(krasin): use contexts. Or use grpc and delete this code.
 		return "", errors.New("Hello: timed out")
 	}
+	// The version and the capabilities come in the same update as the device name.
+	// Old servers don't send them.
+	c.nd.Flush()
+	version, _ := lastValue(versionSub)
+	fversion, _ := version.(float64)
+	var serverCaps []string
+	if caps, ok := lastValue(capsSub); ok {
+		arr, _ := caps.([]interface{})
+		for _, v := range arr {
+			if s, ok := v.(string); ok {
+				serverCaps = append(serverCaps, s)
+			}
+		}
+	}
+	c.mu.Lock()
+	c.protocolVersion = negotiateProtocolVersion(int(fversion))
+	c.serverCaps = serverCaps
+	c.mu.Unlock()
+	c.startOfflineFlush()
 	return deviceName, nil
 }
 
+// ProtocolVersion returns the protocol version negotiated in Hello, or 1 (the legacy version)
+// before Hello.
+func (c *Client) ProtocolVersion() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocolVersion == 0 {
+		return 1
+	}
+	return c.protocolVersion
+}
+
+// mightSupport is like HasCapability, but it's optimistic when the capabilities are unknown:
+// before Hello, or when the agent info is not set.
+func (c *Client) mightSupport(capability string) bool {
+	c.mu.Lock()
+	unknown := c.agent == nil || c.protocolVersion == 0
+	c.mu.Unlock()
+	return unknown || c.HasCapability(capability)
+}
+
+// HasCapability reports whether both the agent (see SetAgentInfo) and the server support the feature.
+// It's always false before Hello.
+func (c *Client) HasCapability(capability string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.agent == nil {
+		return false
+	}
+	return hasCapability(c.agent.Capabilities, capability) && hasCapability(c.serverCaps, capability)
+}
+
+// Notify sends the message to the server. If the offline queue is set (see SetOfflineQueue),
+// the message is queued, when it can't be sent right away.
 func (c *Client) Notify(msg *UplinkMessage) error {
+	m := *msg
+	if m.ID == "" {
+		m.ID = newMessageID()
+	}
+	if m.CreatedAt == 0 {
+		m.CreatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	q, offline := c.queueOffline()
+	if offline {
+		if err := q.Push(&m); err != nil {
+			return err
+		}
+		// The flusher might have emptied the queue and stopped after queueOffline.
+		c.startOfflineFlush()
+		return nil
+	}
+	err := c.sendNotify(&m)
+	if err != nil && q != nil {
+		logger.Info("Failed to send a message. Saving it to the offline queue", "err", err)
+		return q.Push(&m)
+	}
+	return err
+}
+
+func (c *Client) sendNotify(msg *UplinkMessage) error {
 	return send(c.conn, &Request{
 		Cmd: "notify",
-		Msg: msg,
+		Msg: msg.withWireVersion(c.ProtocolVersion()),
+	})
+}
+
+// NotifyJobEvent reports a change in the lifecycle of a job. UplinkMessage.Success is set
+// only for a finished job.
+func (c *Client) NotifyJobEvent(ev *job.Event) error {
+	return c.Notify(&UplinkMessage{
+		Type:     string(ev.Type),
+		JobName:  ev.JobName,
+		Success:  ev.Type == job.EventFinished,
+		Comment:  ev.Comment,
+		JobEvent: ev,
+	})
+}
+
+func (c *Client) SendTerminalOutput(batch *TerminalBatch) error {
+	return send(c.conn, &Request{
+		Cmd:      "terminal",
+		Terminal: batch,
 	})
 }
 
+// SendCameraFrame sends a camera frame as a binary message. Unlike UplinkMessage.Cameras,
+// the frame does not go through the JSON state on the server.
+func (c *Client) SendCameraFrame(frame *CameraFrame) error {
+	if !c.mightSupport(CapBinaryFrames) {
+		return ErrNotSupported
+	}
+	data, err := EncodeCameraFrame(frame)
+	if err != nil {
+		return fmt.Errorf("failed to encode a camera frame: %v", err)
+	}
+	return c.conn.SendBinary(data)
+}
+
+// Frames returns the latest camera frames received from the server.
+func (c *Client) Frames() *FrameStore {
+	return c.frames
+}
+
 func (c *Client) SubString(path string) (*pubsub.StringSub, error) {
 	return c.nd.SubString(path)
 }
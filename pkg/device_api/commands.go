@@ -0,0 +1,206 @@
+package device_api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/robodone/robosla-common/pkg/opapi"
+)
+
+var ErrServerStopped = errors.New("server is stopped")
+
+// CommandHandler executes a downlink command on the device. If it returns an error,
+// the command is acknowledged with StatusError.
+type CommandHandler func(cmd *Command) error
+
+// ackHandler is a command handler which may fill additional fields of the ack.
+type ackHandler func(cmd *Command, ack *Ack) error
+
+// HandleCommand registers the handler for the command name, replacing the previous one.
+func (c *Client) HandleCommand(name string, h CommandHandler) {
+	c.handleCommandAck(name, func(cmd *Command, ack *Ack) error {
+		return h(cmd)
+	})
+}
+
+func (c *Client) handleCommandAck(name string, h ackHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handlers == nil {
+		c.handlers = make(map[string]ackHandler)
+	}
+	c.handlers[name] = h
+}
+
+// The number of commands waiting for execution, after which new commands are rejected.
+const maxPendingCommands = 64
+
+// queueCommand schedules the command from the server for execution. The commands are executed
+// one by one in the order they were received, so that, for example, pause and resume
+// are never reordered.
+func (c *Client) queueCommand(cmd *Command) {
+	select {
+	case c.commands <- cmd:
+	default:
+		// Don't block the other messages from the server.
+		logger.Warn("Too many pending commands", "cmd", cmd.Name, "id", cmd.ID)
+		ack := &Ack{ID: cmd.ID, Status: StatusError, Error: "too many pending commands"}
+		if err := c.sendAck(ack); err != nil {
+			logger.Warn("Failed to acknowledge a command", "cmd", cmd.Name, "id", cmd.ID, "err", err)
+		}
+	}
+}
+
+func (c *Client) runCommands() {
+	for {
+		select {
+		case <-c.stopped:
+			return
+		case cmd := <-c.commands:
+			c.runCommand(cmd)
+		}
+	}
+}
+
+func (c *Client) runCommand(cmd *Command) {
+	c.mu.Lock()
+	h := c.handlers[cmd.Name]
+	c.mu.Unlock()
+	ack := &Ack{ID: cmd.ID, Status: StatusOK}
+	var err error
+	if h == nil {
+		err = fmt.Errorf("unsupported command %q", cmd.Name)
+	} else {
+		err = h(cmd, ack)
+	}
+	if err != nil {
+		logger.Warn("Command failed", "cmd", cmd.Name, "id", cmd.ID, "err", err)
+		ack.Status = StatusError
+		ack.Error = err.Error()
+	}
+	if err := c.sendAck(ack); err != nil {
+		logger.Warn("Failed to acknowledge a command", "cmd", cmd.Name, "id", cmd.ID, "err", err)
+	}
+}
+
+func (c *Client) sendAck(ack *Ack) error {
+	return send(c.conn, &Request{
+		Cmd: "ack",
+		Ack: ack,
+	})
+}
+
+// SendCommand sends a downlink command to the device and waits for its acknowledgement.
+// If the command has no ID, a unique one is assigned. An error is returned if the device
+// replied with an error, or if ctx is done before the ack is received.
+func (srv *Server) SendCommand(ctx context.Context, cmd *Command) (*Ack, error) {
+	return srv.sendCommand(ctx, cmd, nil)
+}
+
+// sendCommand is SendCommand, which sends the command as the binary message returned by encode,
+// if it's not nil. encode is called after the ID of the command is assigned.
+func (srv *Server) sendCommand(ctx context.Context, cmd *Command, encode func() ([]byte, error)) (*Ack, error) {
+	srv.mu.Lock()
+	if cmd.ID == "" {
+		srv.cmdCnt++
+		cmd.ID = strconv.FormatInt(srv.cmdCnt, 10)
+	}
+	if _, ok := srv.pending[cmd.ID]; ok {
+		srv.mu.Unlock()
+		return nil, fmt.Errorf("command with id %q is already pending", cmd.ID)
+	}
+	ch := make(chan *Ack, 1)
+	srv.pending[cmd.ID] = ch
+	srv.mu.Unlock()
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.pending, cmd.ID)
+		srv.mu.Unlock()
+	}()
+
+	var err error
+	if encode != nil {
+		var data []byte
+		if data, err = encode(); err == nil {
+			err = srv.conn.SendBinary(data)
+		}
+	} else {
+		err = send(srv.conn, &Response{Status: StatusOK, Command: cmd})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send command %q: %v", cmd.Name, err)
+	}
+	select {
+	case ack := <-ch:
+		if ack.Status != StatusOK {
+			return ack, fmt.Errorf("command %q failed on the device: %s", cmd.Name, ack.Error)
+		}
+		return ack, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("command %q: %v", cmd.Name, ctx.Err())
+	case <-srv.stopped:
+		return nil, ErrServerStopped
+	}
+}
+
+func (srv *Server) handleAck(ack *Ack) {
+	if ack == nil {
+		logger.Warn("ack without a body, ignoring...")
+		return
+	}
+	srv.mu.Lock()
+	ch, ok := srv.pending[ack.ID]
+	srv.mu.Unlock()
+	if !ok {
+		logger.Warn("Unexpected ack (probably, timed out), ignoring...", "id", ack.ID)
+		return
+	}
+	select {
+	case ch <- ack:
+	default:
+		logger.Warn("Duplicate ack, ignoring...", "id", ack.ID)
+	}
+}
+
+func (srv *Server) StartJob(ctx context.Context, jobName string) error {
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdStartJob, JobName: jobName})
+	return err
+}
+
+func (srv *Server) Pause(ctx context.Context) error {
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdPause})
+	return err
+}
+
+func (srv *Server) Resume(ctx context.Context) error {
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdResume})
+	return err
+}
+
+func (srv *Server) Cancel(ctx context.Context) error {
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdCancel})
+	return err
+}
+
+// Home homes the specified axes, or all axes if none specified.
+func (srv *Server) Home(ctx context.Context, axes ...string) error {
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdHome, Axes: axes})
+	return err
+}
+
+func (srv *Server) SetGripper(ctx context.Context, gripperState opapi.GripperState) error {
+	if !gripperState.Known() || gripperState == opapi.GripperStateUnknown {
+		return fmt.Errorf("invalid gripper state %q", gripperState)
+	}
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdSetGripper, GripperState: gripperState})
+	return err
+}
+
+// RequestCameraFrame asks the device to send a fresh frame from the camera.
+// The frame itself arrives as a binary message and is saved to Frames().
+func (srv *Server) RequestCameraFrame(ctx context.Context, camera string) error {
+	_, err := srv.SendCommand(ctx, &Command{Name: CmdRequestCameraFrame, Camera: camera})
+	return err
+}
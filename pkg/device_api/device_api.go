@@ -2,12 +2,20 @@ package device_api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/robodone/robosla-common/pkg/autoupdate"
+	"github.com/robodone/robosla-common/pkg/logging"
+	"github.com/robodone/robosla-common/pkg/syncws"
 )
 
+var ErrNotSupported = errors.New("the feature is not supported by the other side")
+
+var logger = logging.For("device_api")
+
 const (
 	TestAPIServer = "test1.robosla.com"
 	ProdAPIServer = "prod1.robosla.com"
@@ -31,6 +39,36 @@ type Conn interface {
 
 	In() <-chan *Message
 	Send(data string) error
+	SendBinary(data []byte) error
+}
+
+// ConnStats is implemented by Conns which report the health of the underlying connection,
+// like WSConn. Conns wrapping other Conns, like RecordingConn, forward it.
+type ConnStats interface {
+	// Err returns the error which closed In(), or nil while the connection is alive.
+	Err() error
+	// RTT returns the round-trip time to the other side. Zero, if it's not known yet.
+	RTT() time.Duration
+	// Stats returns the traffic counters.
+	Stats() syncws.Stats
+	// Dropped returns the number of outgoing messages of the class dropped due to the queue limits.
+	Dropped(p Priority) int64
+}
+
+// noStats is ConnStats of a Conn which does not report them.
+type noStats struct{}
+
+func (noStats) Err() error               { return nil }
+func (noStats) RTT() time.Duration       { return 0 }
+func (noStats) Stats() syncws.Stats      { return syncws.Stats{} }
+func (noStats) Dropped(p Priority) int64 { return 0 }
+
+// statsOf returns ConnStats of conn, or zero stats, if conn does not implement it.
+func statsOf(conn Conn) ConnStats {
+	if cs, ok := conn.(ConnStats); ok {
+		return cs
+	}
+	return noStats{}
 }
 
 func send(conn Conn, obj interface{}) error {
@@ -38,5 +76,8 @@ func send(conn Conn, obj interface{}) error {
 	if err != nil {
 		return fmt.Errorf("failed to marshal a message to json: %v", err)
 	}
+	if pc, ok := conn.(PriorityConn); ok {
+		return pc.SendPriority(priorityOf(obj), string(data))
+	}
 	return conn.Send(string(data))
 }
@@ -1,14 +1,40 @@
 package device_api
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/robodone/robosla-common/pkg/job"
 	"github.com/robodone/robosla-common/pkg/pubsub"
+	"github.com/robodone/robosla-common/pkg/terminal"
 )
 
-const testBacklogSize = 1
+// The number of messages a TestConn buffers before Send fails, like a real connection
+// with a full outbound queue.
+const testBacklogSize = 64
+
+const testHMACKey = "this is a test key, which is long enough"
 
 var (
 	TestGoodCookie = "this cookie is good"
@@ -18,24 +44,45 @@ var (
 type TestConn struct {
 	in  <-chan *Message
 	out chan<- *Message
+
+	mu     sync.Mutex
+	closed bool
 }
 
 func (tc *TestConn) In() <-chan *Message {
 	return tc.in
 }
 
-func (tc *TestConn) Send(data string) error {
+func (tc *TestConn) send(msg *Message) error {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.closed {
+		return ErrConnClosed
+	}
 	select {
-	case tc.out <- &Message{Type: websocket.TextMessage, Data: []byte(data)}:
+	case tc.out <- msg:
 	default:
 		return errors.New("failed to send a message due to a backlog")
 	}
 	return nil
 }
 
+func (tc *TestConn) Send(data string) error {
+	return tc.send(&Message{Type: websocket.TextMessage, Data: []byte(data)})
+}
+
+func (tc *TestConn) SendBinary(data []byte) error {
+	// Like a real connection, the message must not change, if the caller reuses data.
+	return tc.send(&Message{Type: websocket.BinaryMessage, Data: append([]byte(nil), data...)})
+}
+
 func (tc *TestConn) Close() error {
-	// It's the responsibility of the caller to not write into Out() if the connection was closed.
-	close(tc.out)
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if !tc.closed {
+		tc.closed = true
+		close(tc.out)
+	}
 	return nil
 }
 
@@ -54,7 +101,7 @@ func newTestConnPair() (Conn, Conn) {
 type TestServerImpl struct {
 }
 
-func (ts *TestServerImpl) Hello(cookie, jobName string, resp *Response) error {
+func (ts *TestServerImpl) Hello(sess *Session, cookie, jobName string, resp *Response) error {
 	if cookie == TestGoodCookie {
 		resp.Login = &Login{
 			DeviceName: TestDeviceName,
@@ -64,11 +111,11 @@ func (ts *TestServerImpl) Hello(cookie, jobName string, resp *Response) error {
 	return errors.New("bad cookie")
 }
 
-func (ts *TestServerImpl) RegisterDevice(cookie string, resp *Response) error {
+func (ts *TestServerImpl) RegisterDevice(sess *Session, cookie string, resp *Response) error {
 	return errors.New("TestServerImpl.RegisterDevice: not implemented")
 }
 
-func (ts *TestServerImpl) Notify(msg *UplinkMessage, resp *Response) error {
+func (ts *TestServerImpl) Notify(sess *Session, msg *UplinkMessage, resp *Response) error {
 	return errors.New("TestServerImpl.SendTerminalOutput: not implemented")
 }
 
@@ -107,4 +154,1089 @@ func TestHelloOK(t *testing.T) {
 	if deviceName != TestDeviceName {
 		t.Errorf("Wrong device name. Want: %s, got: %s", TestDeviceName, deviceName)
 	}
+	if v := client.ProtocolVersion(); v != ProtocolVersion {
+		t.Errorf("Wrong negotiated protocol version. Want: %d, got: %d", ProtocolVersion, v)
+	}
+}
+
+// startTestPair creates a server and a client connected with a test connection.
+// The returned cleanup function stops both and waits for the server to exit before closing
+// the connections, so that nobody writes into a closed connection.
+func startTestPair(impl Impl) (*Server, *Client, func()) {
+	conn0, conn1 := newTestConnPair()
+	srv := NewServer(conn0, impl)
+	done := make(chan bool)
+	go func() {
+		srv.Run()
+		close(done)
+	}()
+	client := NewClient(conn1, pubsub.NewNode())
+	return srv, client, func() {
+		client.Stop()
+		srv.Stop()
+		<-done
+		conn1.Close()
+		conn0.Close()
+	}
+}
+
+// startSession is like startTestPair, but it also establishes the session with hello.
+func startSession(t *testing.T, impl Impl) (*Server, *Client, func()) {
+	srv, client, cleanup := startTestPair(impl)
+	if _, err := client.Hello(TestGoodCookie, "" /*jobName*/); err != nil {
+		cleanup()
+		t.Fatalf("Hello: %v", err)
+	}
+	return srv, client, cleanup
+}
+
+func TestCameraFrame(t *testing.T) {
+	srv, client, cleanup := startSession(t, new(TestServerImpl))
+	defer cleanup()
+
+	want := &CameraFrame{
+		Camera:      "top",
+		TS:          time.Unix(1500000000, 123),
+		ContentType: "image/jpeg",
+		Data:        []byte{0xff, 0xd8, 0xff, 0xd9},
+	}
+	if err := client.SendCameraFrame(want); err != nil {
+		t.Fatalf("SendCameraFrame: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		got, ok := srv.Frames().Latest("top")
+		if ok {
+			if !got.TS.Equal(want.TS) || got.Camera != want.Camera || got.ContentType != want.ContentType ||
+				!bytes.Equal(got.Data, want.Data) {
+				t.Errorf("Unexpected frame: %+v, want: %+v", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Camera frame was not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type testTerminalImpl struct {
+	TestServerImpl
+	buf *terminal.Buffer
+}
+
+func (ti *testTerminalImpl) TerminalOutput(sess *Session, batch *TerminalBatch, resp *Response) error {
+	ti.buf.Add(batch.Lines...)
+	return nil
+}
+
+func TestTerminalWriter(t *testing.T) {
+	impl := &testTerminalImpl{buf: terminal.NewBuffer(10)}
+	_, client, cleanup := startSession(t, impl)
+	defer cleanup()
+
+	tw := NewTerminalWriter(client, TerminalWriterOptions{FlushInterval: time.Millisecond})
+	fmt.Fprintf(tw, "hello\nwor")
+	fmt.Fprintf(tw, "ld\r\nlast")
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := []terminal.Line{{Seq: 1, Text: "hello"}, {Seq: 2, Text: "world"}, {Seq: 3, Text: "last"}}
+	deadline := time.Now().Add(time.Second)
+	for impl.buf.LastSeq() < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	got := impl.buf.Tail(10)
+	for i := range got {
+		got[i].TS = 0
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected terminal output: %+v, want: %+v", got, want)
+	}
+	if _, err := fmt.Fprintf(tw, "too late\n"); err != ErrTerminalWriterClosed {
+		t.Errorf("Write after Close: unexpected error: %v, want: %v", err, ErrTerminalWriterClosed)
+	}
+}
+
+func TestTerminalWriterEvictInflight(t *testing.T) {
+	tw := &TerminalWriter{opts: TerminalWriterOptions{MaxPending: 2}}
+	tw.appendLocked("a")
+	tw.appendLocked("b")
+	// The batch with the first line is being sent.
+	tw.inflightSeq = 1
+	tw.appendLocked("c")
+	tw.appendLocked("d")
+	if tw.dropped != 1 || tw.inflightDropped != 1 {
+		t.Errorf("Unexpected drop counts: dropped=%d, inflightDropped=%d, want: 1 and 1", tw.dropped, tw.inflightDropped)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	srv, client, cleanup := startSession(t, new(TestServerImpl))
+	defer cleanup()
+
+	homed := make(chan []string, 1)
+	client.HandleCommand(CmdHome, func(cmd *Command) error {
+		homed <- cmd.Axes
+		return nil
+	})
+	client.HandleCommand(CmdPause, func(cmd *Command) error {
+		return errors.New("nothing to pause")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Home(ctx, "z"); err != nil {
+		t.Fatalf("Home: %v", err)
+	}
+	if got := <-homed; !reflect.DeepEqual(got, []string{"z"}) {
+		t.Errorf("Unexpected axes: %q, want: [z]", got)
+	}
+	if err := srv.Pause(ctx); err == nil || !strings.Contains(err.Error(), "nothing to pause") {
+		t.Errorf("Pause: unexpected error: %v", err)
+	}
+	if err := srv.Resume(ctx); err == nil || !strings.Contains(err.Error(), "unsupported command") {
+		t.Errorf("Resume: unexpected error: %v", err)
+	}
+}
+
+func TestCommandOrder(t *testing.T) {
+	srv, client, cleanup := startSession(t, new(TestServerImpl))
+	defer cleanup()
+
+	done := make(chan string, 2)
+	client.HandleCommand(CmdPause, func(cmd *Command) error {
+		time.Sleep(20 * time.Millisecond)
+		done <- cmd.Name
+		return nil
+	})
+	client.HandleCommand(CmdResume, func(cmd *Command) error {
+		done <- cmd.Name
+		return nil
+	})
+	for _, name := range []string{CmdPause, CmdResume} {
+		if err := send(srv.conn, &Response{Status: StatusOK, Command: &Command{ID: name, Name: name}}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	for _, want := range []string{CmdPause, CmdResume} {
+		select {
+		case got := <-done:
+			if got != want {
+				t.Errorf("Unexpected command: %s, want: %s", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", want)
+		}
+	}
+}
+
+func TestSendFile(t *testing.T) {
+	t.Run("json", func(t *testing.T) { testSendFile(t, false) })
+	t.Run("binary", func(t *testing.T) { testSendFile(t, true) })
+}
+
+func testSendFile(t *testing.T, binaryChunks bool) {
+	dir, err := ioutil.TempDir("", "device_api")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	recv, err := NewDiskReceiver(dir)
+	if err != nil {
+		t.Fatalf("NewDiskReceiver: %v", err)
+	}
+
+	srv, client, cleanup := startTestPair(new(TestServerImpl))
+	defer cleanup()
+	if binaryChunks {
+		client.SetAgentInfo(NewAgentInfo("dev"))
+	}
+	if _, err := client.Hello(TestGoodCookie, "" /*jobName*/); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if got := srv.HasCapability(CapBinaryChunks); got != binaryChunks {
+		t.Fatalf("HasCapability(%s): %v, want: %v", CapBinaryChunks, got, binaryChunks)
+	}
+	client.HandleTransfers(recv)
+
+	content := bytes.Repeat([]byte("0123456789"), DefaultChunkSize/4)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Simulate an interrupted transfer: the device already has the first chunk.
+	tr := &FileTransfer{Name: "job.gcode", Size: int64(len(content)), SHA256: sha256Hex(content)}
+	tr.ID = transferID(tr.Name, tr.SHA256)
+	if _, err := recv.Begin(tr); err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	first := &FileChunk{TransferID: tr.ID, Data: content[:DefaultChunkSize]}
+	if err := recv.WriteChunk(first); err != nil {
+		t.Fatalf("WriteChunk: %v", err)
+	}
+
+	var progress []int64
+	err = srv.SendFile(ctx, "job.gcode", bytes.NewReader(content), int64(len(content)), func(sent, total int64) {
+		progress = append(progress, sent)
+	})
+	if err != nil {
+		t.Fatalf("SendFile: %v", err)
+	}
+	want := []int64{2 * DefaultChunkSize, int64(len(content))}
+	if !reflect.DeepEqual(progress, want) {
+		t.Errorf("Unexpected progress: %v, want: %v (resumed after the first chunk)", progress, want)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "job.gcode"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("Received file differs from the sent one")
+	}
+
+	// The reader is shorter than the declared size.
+	err = srv.SendFile(ctx, "short.gcode", bytes.NewReader(content), int64(len(content))+1, nil)
+	if err == nil || !strings.Contains(err.Error(), "unexpected end of file") {
+		t.Errorf("SendFile with a short reader: unexpected error: %v", err)
+	}
+	for _, name := range []string{"", ".", "..", "/"} {
+		if err := srv.SendFile(ctx, name, bytes.NewReader(content), 10, nil); err == nil {
+			t.Errorf("SendFile(%q) succeeded", name)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	srv, client, cleanup := startTestPair(new(TestServerImpl))
+	defer cleanup()
+
+	srv.SetCapabilities(CapCommands)
+	client.SetAgentInfo(NewAgentInfo("dev"))
+	if _, err := client.Hello(TestGoodCookie, "" /*jobName*/); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if !client.HasCapability(CapCommands) || !srv.HasCapability(CapCommands) {
+		t.Errorf("%s is expected to be supported by both sides", CapCommands)
+	}
+	if client.HasCapability(CapBinaryFrames) || srv.HasCapability(CapBinaryFrames) {
+		t.Errorf("%s is not supported by the server, but it's enabled", CapBinaryFrames)
+	}
+	if agent := srv.Agent(); agent == nil || agent.Version != "dev" {
+		t.Errorf("Unexpected agent info on the server: %+v", agent)
+	}
+	if err := client.SendCameraFrame(&CameraFrame{Camera: "top"}); err != ErrNotSupported {
+		t.Errorf("SendCameraFrame: %v, want: %v", err, ErrNotSupported)
+	}
+}
+
+func testHMACAuthenticator(t *testing.T, key string) *HMACAuthenticator {
+	a, err := NewHMACAuthenticator([]byte(key), time.Hour)
+	if err != nil {
+		t.Fatalf("NewHMACAuthenticator: %v", err)
+	}
+	return a
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	for _, key := range []string{"", "secret"} {
+		if _, err := NewHMACAuthenticator([]byte(key), time.Hour); err == nil {
+			t.Errorf("NewHMACAuthenticator(%q) accepted a short key", key)
+		}
+	}
+	a := testHMACAuthenticator(t, testHMACKey)
+	now := time.Unix(1500000000, 0)
+	a.now = func() time.Time { return now }
+	token, err := a.Issue(TestDeviceName)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	id, err := a.Authenticate(token)
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if id.DeviceName != TestDeviceName || !id.Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("Unexpected identity: %+v", id)
+	}
+	if _, err := testHMACAuthenticator(t, strings.ToUpper(testHMACKey)).Authenticate(token); err != ErrInvalidToken {
+		t.Errorf("Authenticate with a wrong key: %v, want: %v", err, ErrInvalidToken)
+	}
+	if _, err := a.Authenticate("x" + token); err != ErrInvalidToken {
+		t.Errorf("Authenticate a tampered token: %v, want: %v", err, ErrInvalidToken)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := a.Authenticate(token); err != ErrTokenExpired {
+		t.Errorf("Authenticate an expired token: %v, want: %v", err, ErrTokenExpired)
+	}
+}
+
+// authTestImpl leaves the authentication to the Authenticator.
+type authTestImpl struct {
+	TestServerImpl
+	notified chan *Session
+}
+
+func (ti *authTestImpl) Hello(sess *Session, cookie, jobName string, resp *Response) error {
+	return nil
+}
+
+func (ti *authTestImpl) Notify(sess *Session, msg *UplinkMessage, resp *Response) error {
+	ti.notified <- sess
+	return nil
+}
+
+func TestAuthenticator(t *testing.T) {
+	impl := &authTestImpl{notified: make(chan *Session, 1)}
+	srv, client, cleanup := startTestPair(impl)
+	defer cleanup()
+	a := testHMACAuthenticator(t, testHMACKey)
+	srv.SetAuthenticator(a)
+
+	errSub, err := client.SubString("error")
+	if err != nil {
+		t.Fatalf("SubString: %v", err)
+	}
+	defer errSub.Unsub()
+	if err := client.Notify(&UplinkMessage{Type: "progress"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	select {
+	case msg := <-errSub.C():
+		if !strings.Contains(msg, "not authenticated") {
+			t.Errorf("Unexpected error for an unauthenticated notify: %q", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify before hello: timed out waiting for an error")
+	}
+
+	token, err := a.Issue(TestDeviceName)
+	if err != nil {
+		t.Fatalf("Issue: %v", err)
+	}
+	deviceName, err := client.Hello(token, "job1")
+	if err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if deviceName != TestDeviceName {
+		t.Errorf("Wrong device name. Want: %s, got: %s", TestDeviceName, deviceName)
+	}
+	if id := srv.Identity(); id == nil || id.DeviceName != TestDeviceName {
+		t.Errorf("Unexpected identity on the server: %+v", id)
+	}
+	if err := client.Notify(&UplinkMessage{Type: "progress"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	select {
+	case sess := <-impl.notified:
+		if !sess.Authenticated() || sess.DeviceName != TestDeviceName || sess.JobName != "job1" {
+			t.Errorf("Unexpected session passed to Notify: %+v", sess)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify after hello: timed out")
+	}
+
+	rotated, err := client.RotateToken()
+	if err != nil {
+		t.Fatalf("RotateToken: %v", err)
+	}
+	if id, err := a.Authenticate(rotated); err != nil || id.DeviceName != TestDeviceName {
+		t.Errorf("Rotated token: identity %+v, err: %v", id, err)
+	}
+}
+
+type pairingTestImpl struct {
+	TestServerImpl
+}
+
+func (ti *pairingTestImpl) RegisterDevice(sess *Session, cookie string, resp *Response) error {
+	if cookie != TestGoodCookie {
+		return errors.New("bad cookie")
+	}
+	resp.Login = &Login{Cookie: "device cookie", DeviceName: TestDeviceName}
+	return nil
+}
+
+func TestPairing(t *testing.T) {
+	srv, client, cleanup := startTestPair(new(pairingTestImpl))
+	defer cleanup()
+	store := NewMemPairingStore()
+	srv.SetPairingStore(store)
+
+	if err := store.Confirm("AAAA-AAAA", TestGoodCookie); err != ErrUnknownPairingCode {
+		t.Errorf("Confirm(unknown code): %v, want: %v", err, ErrUnknownPairingCode)
+	}
+	errSub, err := client.SubString("error")
+	if err != nil {
+		t.Fatalf("SubString: %v", err)
+	}
+	defer errSub.Unsub()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	deviceCookie, err := client.Pair(ctx, func(code string, expires time.Time) {
+		if len(code) != 9 || time.Until(expires) <= 0 {
+			t.Errorf("Unexpected pairing code %q, expires at %v", code, expires)
+		}
+		// An error reply to another command must not abort the pairing.
+		if err := client.SendTerminalOutput(&TerminalBatch{}); err != nil {
+			t.Errorf("SendTerminalOutput: %v", err)
+		}
+		select {
+		case <-errSub.C():
+		case <-time.After(time.Second):
+			t.Errorf("Timed out waiting for an error reply")
+		}
+		// Users don't care about the case and dashes.
+		typed := strings.ToLower(strings.Replace(code, "-", " ", 1))
+		if err := store.Confirm(typed, ""); err == nil {
+			t.Errorf("Confirm(%q) with an empty user cookie succeeded", typed)
+		}
+		if err := store.Confirm(typed, TestGoodCookie); err != nil {
+			t.Errorf("Confirm(%q): %v", typed, err)
+		}
+		if err := store.Confirm(typed, TestGoodCookie); err == nil {
+			t.Errorf("Confirm(%q) succeeded twice", typed)
+		}
+	})
+	if err != nil {
+		t.Fatalf("Pair: %v", err)
+	}
+	if deviceCookie != "device cookie" {
+		t.Errorf("Unexpected device cookie: %q", deviceCookie)
+	}
+}
+
+func TestPairingPerConnection(t *testing.T) {
+	conn0, conn1 := newTestConnPair()
+	defer conn1.Close()
+	srv := NewServer(conn0, new(pairingTestImpl))
+	srv.SetPairingStore(NewMemPairingStore())
+	go srv.Run()
+	defer srv.Stop()
+
+	for i := 0; i < 2; i++ {
+		if err := send(conn1, &Request{Cmd: "pair"}); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	var resps []Response
+	for len(resps) < 2 {
+		select {
+		case msg := <-conn1.In():
+			var resp Response
+			if err := json.Unmarshal(msg.Data, &resp); err != nil {
+				t.Fatalf("Unmarshal(%s): %v", msg.Data, err)
+			}
+			resps = append(resps, resp)
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for pairing responses")
+		}
+	}
+	if resps[0].Pairing == nil {
+		t.Errorf("The first pair request got no code: %+v", resps[0])
+	}
+	if resps[1].Status != StatusError || resps[1].Pairing == nil || !strings.Contains(resps[1].Pairing.Error, "already in progress") {
+		t.Errorf("The second pair request: %+v, want a pairing error", resps[1])
+	}
+}
+
+// newTestClientCert returns a self-signed client certificate and the pool to verify it.
+func newTestClientCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: TestDeviceName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestDialMutualTLS(t *testing.T) {
+	clientCert, clientCAs := newTestClientCert(t)
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/device-api/v1" || r.Header.Get("X-Device") != TestDeviceName {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != TestDeviceName {
+			http.Error(w, "unexpected client certificate", http.StatusForbidden)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"status":"OK"}`))
+		conn.ReadMessage()
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	ts.StartTLS()
+	defer ts.Close()
+
+	serverCAs := x509.NewCertPool()
+	serverCAs.AddCert(ts.Certificate())
+	cfg := &DialConfig{
+		URL:              "wss" + strings.TrimPrefix(ts.URL, "https") + "/device-api/v1",
+		RootCAs:          serverCAs,
+		Certificates:     []tls.Certificate{clientCert},
+		HandshakeTimeout: 5 * time.Second,
+		Header:           http.Header{"X-Device": []string{TestDeviceName}},
+	}
+	conn, err := Dial(cfg)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	select {
+	case msg := <-conn.In():
+		if msg == nil || string(msg.Data) != `{"status":"OK"}` {
+			t.Errorf("Unexpected message: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a message")
+	}
+
+	cfg.Certificates = nil
+	if conn, err := Dial(cfg); err == nil {
+		conn.Close()
+		t.Errorf("Dial without a client certificate succeeded")
+	}
+}
+
+func TestBinaryMessages(t *testing.T) {
+	srv, client, cleanup := startSession(t, new(TestServerImpl))
+	defer cleanup()
+
+	const kind = BinaryKindUser + 1
+	fromDevice := make(chan string, 1)
+	if err := srv.HandleBinary(kind, func(sess *Session, payload []byte) error {
+		fromDevice <- sess.DeviceName + ":" + string(payload)
+		return nil
+	}); err != nil {
+		t.Fatalf("Server.HandleBinary: %v", err)
+	}
+	fromServer := make(chan string, 1)
+	if err := client.HandleBinary(kind, func(payload []byte) error {
+		fromServer <- string(payload)
+		return nil
+	}); err != nil {
+		t.Fatalf("Client.HandleBinary: %v", err)
+	}
+	if err := client.HandleBinary(binaryKindCameraFrame, func([]byte) error { return nil }); err == nil {
+		t.Errorf("HandleBinary with a reserved kind succeeded")
+	}
+
+	if err := client.SendBinary(kind, []byte("up")); err != nil {
+		t.Fatalf("Client.SendBinary: %v", err)
+	}
+	if err := srv.SendBinary(kind, []byte("down")); err != nil {
+		t.Fatalf("Server.SendBinary: %v", err)
+	}
+	for _, tt := range []struct {
+		ch   chan string
+		want string
+	}{{fromDevice, TestDeviceName + ":up"}, {fromServer, "down"}} {
+		select {
+		case got := <-tt.ch:
+			if got != tt.want {
+				t.Errorf("Unexpected binary message: %q, want: %q", got, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", tt.want)
+		}
+	}
+}
+
+func TestWSConnSendClose(t *testing.T) {
+	// The server drops the incoming messages over backlogSize, if it's slow to read them.
+	const n = backlogSize
+	received := make(chan []string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := UpgradeWS(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var got []string
+		for msg := range conn.In() {
+			got = append(got, string(msg.Data))
+		}
+		received <- got
+	}))
+	defer ts.Close()
+
+	conn, err := Dial(&DialConfig{URL: "ws" + strings.TrimPrefix(ts.URL, "http") + "/device-api/v1"})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := conn.Send(fmt.Sprint(i)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	// The queued messages must be sent before the socket is closed.
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := conn.Send("late"); err != ErrConnClosed {
+		t.Errorf("Send after Close: %v, want: %v", err, ErrConnClosed)
+	}
+	select {
+	case got := <-received:
+		if len(got) != n || got[n-1] != fmt.Sprint(n-1) {
+			t.Errorf("Received %d messages, want: %d", len(got), n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the server")
+	}
+}
+
+func TestOutQueues(t *testing.T) {
+	oq := newOutQueues(QueueOptions{Classes: [numPriorities]QueueClass{
+		PriorityControl: {MaxMessages: 1, Drop: DropNone},
+		PriorityStatus:  {MaxMessages: 2, Drop: DropOldest},
+		PriorityBulk:    {MaxBytes: 4, Drop: DropNewest},
+	}})
+	push := func(p Priority, data string) error {
+		return oq.push(p, &outMessage{typ: websocket.TextMessage, data: []byte(data)})
+	}
+	for _, m := range []struct {
+		p    Priority
+		data string
+	}{
+		{PriorityBulk, "b1"},
+		{PriorityStatus, "s1"},
+		{PriorityStatus, "s2"},
+		{PriorityStatus, "s3"},
+		{PriorityBulk, "b2"},
+		{PriorityBulk, "b3"},
+		{PriorityControl, "c1"},
+	} {
+		if err := push(m.p, m.data); err != nil {
+			t.Fatalf("push(%s, %q): %v", m.p, m.data, err)
+		}
+	}
+	if err := push(PriorityControl, "c2"); err != ErrQueueFull {
+		t.Errorf("push to a full control queue: %v, want: %v", err, ErrQueueFull)
+	}
+	var got []string
+	for {
+		msg, _ := oq.pop()
+		if msg == nil {
+			break
+		}
+		got = append(got, string(msg.data))
+	}
+	want := []string{"c1", "s2", "s3", "b1", "b2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected order: %q, want: %q", got, want)
+	}
+	if n := oq.droppedCount(PriorityStatus); n != 1 {
+		t.Errorf("Dropped status messages: %d, want: 1", n)
+	}
+	if n := oq.droppedCount(PriorityBulk); n != 1 {
+		t.Errorf("Dropped bulk messages: %d, want: 1", n)
+	}
+	if err := push(PriorityBulk, "large"); err != ErrMessageTooLarge {
+		t.Errorf("push of a message over MaxBytes: %v, want: %v", err, ErrMessageTooLarge)
+	}
+	if err := push(PriorityStatus, "s4"); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	oq.close()
+	// The messages queued before close are still sent.
+	if msg := oq.wait(); msg == nil || string(msg.data) != "s4" {
+		t.Errorf("wait after close: %v, want: s4", msg)
+	}
+	if msg := oq.wait(); msg != nil {
+		t.Errorf("wait after close: %q, want: nil", msg.data)
+	}
+	if err := push(PriorityStatus, "s5"); err != ErrConnClosed {
+		t.Errorf("push after close: %v, want: %v", err, ErrConnClosed)
+	}
+	if p := priorityOf(&Response{Status: StatusOK, Ack: &Ack{ID: "1", Status: StatusOK}}); p != PriorityControl {
+		t.Errorf("priorityOf(a response with an ack): %s, want: %s", p, PriorityControl)
+	}
+	// Terminal output and file chunks must not be evicted by camera frames.
+	if p := priorityOf(&Request{Cmd: "terminal"}); p != PriorityTransfer {
+		t.Errorf("priorityOf(terminal output): %s, want: %s", p, PriorityTransfer)
+	}
+	if p := priorityOf(&Response{Command: &Command{Chunk: &FileChunk{}}}); p != PriorityTransfer {
+		t.Errorf("priorityOf(a file chunk): %s, want: %s", p, PriorityTransfer)
+	}
+	if p := binaryPriority([]byte{binaryKindFileChunk}); p != PriorityTransfer {
+		t.Errorf("binaryPriority(a file chunk): %s, want: %s", p, PriorityTransfer)
+	}
+	if p := binaryPriority([]byte{binaryKindCameraFrame}); p != PriorityBulk {
+		t.Errorf("binaryPriority(a camera frame): %s, want: %s", p, PriorityBulk)
+	}
+	if c := DefaultQueueOptions.Classes[PriorityTransfer]; c.Drop != DropNone {
+		t.Errorf("Transfer messages are dropped: %+v", c)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "device_api")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenOfflineQueue(dir, DefaultOfflineQueueOptions)
+	if err != nil {
+		t.Fatalf("OpenOfflineQueue: %v", err)
+	}
+	for _, msg := range []*UplinkMessage{
+		{Type: "progress", JobName: "job1", Progress: 0.1},
+		// Replaces the previous progress update.
+		{Type: "progress", JobName: "job1", Progress: 0.2},
+		{Type: string(job.EventFinished), JobName: "job1", JobEvent: &job.Event{Type: job.EventFinished, JobName: "job1"}},
+		{Type: "progress", JobName: "job2", Progress: 0.3},
+	} {
+		if err := q.Push(msg); err != nil {
+			t.Fatalf("Push: %v", err)
+		}
+	}
+	// The queue must survive a restart.
+	q, err = OpenOfflineQueue(dir, DefaultOfflineQueueOptions)
+	if err != nil {
+		t.Fatalf("OpenOfflineQueue: %v", err)
+	}
+	if n := q.Len(); n != 3 {
+		t.Fatalf("Len: %d, want: 3", n)
+	}
+	var got []float64
+	for {
+		msg, ok := q.Peek()
+		if !ok {
+			break
+		}
+		if msg.ID == "" || msg.CreatedAt == 0 {
+			t.Errorf("ID or CreatedAt is not set: %+v", msg)
+		}
+		got = append(got, msg.Progress)
+		q.Remove(msg)
+	}
+	if want := []float64{0.2, 0, 0.3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected queued messages: %v, want: %v", got, want)
+	}
+}
+
+type offlineTestImpl struct {
+	TestServerImpl
+	notified chan *UplinkMessage
+}
+
+func (ti *offlineTestImpl) Notify(sess *Session, msg *UplinkMessage, resp *Response) error {
+	ti.notified <- msg
+	return nil
+}
+
+func TestJobEventValidation(t *testing.T) {
+	impl := &offlineTestImpl{notified: make(chan *UplinkMessage, 10)}
+	srv, client, cleanup := startSession(t, impl)
+	defer cleanup()
+	tracker := job.NewTracker()
+	srv.SetJobTracker(tracker)
+
+	for _, ev := range []*job.Event{
+		{Type: job.EventPrintStarted, JobName: "job1"},
+		// Impossible transition: the job is not paused.
+		{Type: job.EventResumed, JobName: "job1"},
+		{Type: job.EventCancelled, JobName: "job1"},
+	} {
+		if err := client.NotifyJobEvent(ev); err != nil {
+			t.Fatalf("NotifyJobEvent: %v", err)
+		}
+	}
+	for _, want := range []job.EventType{job.EventPrintStarted, job.EventCancelled} {
+		select {
+		case msg := <-impl.notified:
+			if msg.JobEvent == nil || msg.JobEvent.Type != want {
+				t.Errorf("Unexpected message: %+v, want a %s event", msg, want)
+			}
+			if msg.Success {
+				t.Errorf("Success is set for a %s event", want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for a %s event", want)
+		}
+	}
+	if jobName, state := tracker.State(TestDeviceName); jobName != "job1" || state != job.Cancelled {
+		t.Errorf("State: %q, %q, want: job1, cancelled", jobName, state)
+	}
+}
+
+func TestStoreAndForward(t *testing.T) {
+	dir, err := ioutil.TempDir("", "device_api")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	q, err := OpenOfflineQueue(dir, DefaultOfflineQueueOptions)
+	if err != nil {
+		t.Fatalf("OpenOfflineQueue: %v", err)
+	}
+	impl := &offlineTestImpl{notified: make(chan *UplinkMessage, 10)}
+	srv, client, cleanup := startTestPair(impl)
+	defer cleanup()
+	srv.SetDedup(NewDedup(10))
+	client.SetAgentInfo(NewAgentInfo("dev"))
+	client.SetOfflineQueue(q)
+
+	// Before hello, the messages are queued.
+	createdAt := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	first := &UplinkMessage{Type: "progress", JobName: "job1", CreatedAt: createdAt}
+	second := &UplinkMessage{Type: "log", JobName: "job1", Comment: "second"}
+	for _, msg := range []*UplinkMessage{first, second} {
+		if err := client.Notify(msg); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	// Nothing is sent before hello, even after a while.
+	time.Sleep(200 * time.Millisecond)
+	if n := q.Len(); n != 2 {
+		t.Fatalf("Len before hello: %d, want: 2", n)
+	}
+	if _, err := client.Hello(TestGoodCookie, "" /*jobName*/); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	var got []*UplinkMessage
+	for len(got) < 2 {
+		select {
+		case msg := <-impl.notified:
+			got = append(got, msg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the queued messages, got %d", len(got))
+		}
+	}
+	if got[0].Type != "progress" || got[0].CreatedAt != first.CreatedAt || got[1].Comment != "second" {
+		t.Errorf("Unexpected messages: %+v, %+v", got[0], got[1])
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len after flush: %d, want: 0", n)
+	}
+
+	// A resent message is handled once.
+	if err := client.Notify(got[1]); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if err := client.Notify(&UplinkMessage{Type: "log", Comment: "third"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	select {
+	case msg := <-impl.notified:
+		if msg.Comment != "third" {
+			t.Errorf("Unexpected message after a duplicate: %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a message")
+	}
+}
+
+// failingTestImpl fails the first Notify.
+type failingTestImpl struct {
+	offlineTestImpl
+	mu     sync.Mutex
+	failed bool
+}
+
+func (ti *failingTestImpl) Notify(sess *Session, msg *UplinkMessage, resp *Response) error {
+	ti.mu.Lock()
+	failed := ti.failed
+	ti.failed = true
+	ti.mu.Unlock()
+	if !failed {
+		return errors.New("no space left on device")
+	}
+	return ti.offlineTestImpl.Notify(sess, msg, resp)
+}
+
+func TestDedupAfterFailure(t *testing.T) {
+	impl := &failingTestImpl{offlineTestImpl: offlineTestImpl{notified: make(chan *UplinkMessage, 10)}}
+	srv, client, cleanup := startSession(t, impl)
+	defer cleanup()
+	srv.SetDedup(NewDedup(10))
+
+	// The message failed the first time, so the resent one is not a duplicate.
+	msg := &UplinkMessage{ID: "1", Type: "log", Comment: "resent"}
+	for i := 0; i < 2; i++ {
+		if err := client.Notify(msg); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	select {
+	case got := <-impl.notified:
+		if got.Comment != "resent" {
+			t.Errorf("Unexpected message: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the resent message")
+	}
+}
+
+// statsTestConn is a TestConn, which reports a fixed RTT.
+type statsTestConn struct {
+	*TestConn
+	noStats
+}
+
+func (sc statsTestConn) RTT() time.Duration {
+	return 42 * time.Millisecond
+}
+
+func TestRecordingConnStats(t *testing.T) {
+	conn0, conn1 := newTestConnPair()
+	defer conn1.Close()
+	rc := NewRecordingConn(statsTestConn{TestConn: conn0.(*TestConn)}, ioutil.Discard)
+	defer rc.Close()
+	var cs ConnStats = rc
+	if got := cs.RTT(); got != 42*time.Millisecond {
+		t.Errorf("RTT: %v, want: 42ms", got)
+	}
+}
+
+func TestRecordedMessageKind(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		want int
+	}{
+		{`{"t":"2020-01-01T00:00:00Z","dir":"in","kind":"binary"}`, websocket.BinaryMessage},
+		{`{"t":"2020-01-01T00:00:00Z","dir":"in","kind":"text"}`, websocket.TextMessage},
+		// Older recordings.
+		{`{"t":"2020-01-01T00:00:00Z","dir":"in","binary":"AQI="}`, websocket.BinaryMessage},
+		{`{"t":"2020-01-01T00:00:00Z","dir":"in","text":"{}"}`, websocket.TextMessage},
+	} {
+		recording, err := ReadRecording(strings.NewReader(tt.line))
+		if err != nil {
+			t.Fatalf("ReadRecording(%s): %v", tt.line, err)
+		}
+		if got := recording[0].message().Type; got != tt.want {
+			t.Errorf("message type of %s: %d, want: %d", tt.line, got, tt.want)
+		}
+	}
+	// An empty binary message is replayed as binary.
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(recordedMessage(DirIn, &Message{Type: websocket.BinaryMessage})); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	recording, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatalf("ReadRecording: %v", err)
+	}
+	if got := recording[0].message().Type; got != websocket.BinaryMessage {
+		t.Errorf("message type of an empty binary message: %d, want: %d", got, websocket.BinaryMessage)
+	}
+}
+
+func TestRecordingConnClose(t *testing.T) {
+	conn0, conn1 := newTestConnPair()
+	defer conn1.Close()
+	rec := NewRecordingConn(conn0, ioutil.Discard)
+	// Nobody reads In(), so the recorder is blocked after backlogSize messages.
+	for i := 0; i < backlogSize+3; i++ {
+		if err := conn1.Send("{}"); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	rec.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-rec.In():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("In() is not closed after Close")
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	conn0, conn1 := newTestConnPair()
+	var buf bytes.Buffer
+	rec := NewRecordingConn(conn0, &buf)
+	srv := NewServer(rec, new(TestServerImpl))
+	done := make(chan bool)
+	go func() {
+		srv.Run()
+		close(done)
+	}()
+	client := NewClient(conn1, pubsub.NewNode())
+	if _, err := client.Hello(TestGoodCookie, "" /*jobName*/); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	if err := client.SendCameraFrame(&CameraFrame{Camera: "top", TS: time.Unix(1500000000, 0), Data: []byte{1, 2, 3}}); err != nil {
+		t.Fatalf("SendCameraFrame: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := srv.Frames().Latest("top"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the camera frame was not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	client.Stop()
+	srv.Stop()
+	<-done
+	conn1.Close()
+	rec.Close()
+
+	recording, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatalf("ReadRecording: %v", err)
+	}
+	var dirs []string
+	for _, rm := range recording {
+		dirs = append(dirs, rm.Dir+":"+rm.Kind)
+	}
+	if want := []string{"in:text", "out:text", "in:binary"}; !reflect.DeepEqual(dirs, want) {
+		t.Fatalf("recorded messages: %v, want %v", dirs, want)
+	}
+	if !strings.Contains(recording[0].Text, TestGoodCookie) {
+		t.Errorf("the recorded hello does not contain the cookie: %s", recording[0].Text)
+	}
+
+	replay := NewReplayConn(recording, DirIn, 0)
+	srv = NewServer(replay, new(TestServerImpl))
+	done = make(chan bool)
+	go func() {
+		srv.Run()
+		close(done)
+	}()
+	<-replay.Done()
+	replay.Close()
+	<-done
+	sent := replay.Sent()
+	if len(sent) != 1 || sent[0].Text != recording[1].Text {
+		t.Errorf("replayed responses: %+v, want %q", sent, recording[1].Text)
+	}
+	if _, ok := srv.Frames().Latest("top"); !ok {
+		t.Errorf("the replayed camera frame was not received")
+	}
 }
@@ -0,0 +1,249 @@
+// Package devicetest helps to test the code built on device_api: an in-memory connection pair
+// with fault injection, a fake server Impl and helpers to start a Server and a Client.
+package devicetest
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/syncws"
+)
+
+// Faults are injected into the messages sent through a Conn.
+type Faults struct {
+	// Every message is delivered after Latency plus a random delay up to Jitter.
+	// The order of the messages is preserved.
+	Latency time.Duration
+	Jitter  time.Duration
+	// The probability for a message to be silently lost, from 0 to 1.
+	DropRate float64
+	// The connection is broken after this many more messages are sent and the last one is
+	// delivered. The messages sent after it fail with device_api.ErrConnClosed. Zero disables it.
+	DisconnectAfter int
+}
+
+// link is the state shared by both ends of a connection.
+type link struct {
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+func (l *link) close() {
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+type delivery struct {
+	at  time.Time
+	msg *device_api.Message
+	// The connection is broken after this message is delivered.
+	last bool
+}
+
+// Conn is one end of an in-memory connection, created by Pipe. Send never blocks:
+// the messages are queued until the other side reads them. Closing either end breaks
+// the connection for both, like closing a socket, and the undelivered messages are lost.
+type Conn struct {
+	link *link
+	in   chan *device_api.Message
+	peer *Conn
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	faults  Faults
+	queue   []*delivery
+	lastAt  time.Time
+	sent    int
+	lost    int
+	written int64
+	wake    chan bool
+	// Set after the last message allowed by Faults.DisconnectAfter is sent.
+	broken bool
+}
+
+// Pipe returns both ends of a new connection.
+func Pipe() (*Conn, *Conn) {
+	l := &link{closed: make(chan bool)}
+	a := newConn(l, 1)
+	b := newConn(l, 2)
+	a.peer, b.peer = b, a
+	go a.deliver()
+	go b.deliver()
+	return a, b
+}
+
+func newConn(l *link, seed int64) *Conn {
+	return &Conn{
+		link: l,
+		in:   make(chan *device_api.Message),
+		rnd:  rand.New(rand.NewSource(seed)),
+		wake: make(chan bool, 1),
+	}
+}
+
+// SetFaults sets the faults injected into the messages sent from this end.
+func (c *Conn) SetFaults(f Faults) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = f
+}
+
+// Sent returns the number of messages sent from this end, including the lost ones.
+func (c *Conn) Sent() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sent
+}
+
+// Lost returns the number of messages lost due to Faults.DropRate.
+func (c *Conn) Lost() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lost
+}
+
+func (c *Conn) latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.faults.Latency
+}
+
+func (c *Conn) payloadWritten() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
+
+// Err implements device_api.ConnStats. It returns device_api.ErrConnClosed after the connection is broken.
+func (c *Conn) Err() error {
+	if c.Closed() {
+		return device_api.ErrConnClosed
+	}
+	return nil
+}
+
+// RTT implements device_api.ConnStats. It's the sum of the latencies of both ends.
+func (c *Conn) RTT() time.Duration {
+	return c.latency() + c.peer.latency()
+}
+
+// Stats implements device_api.ConnStats. The payload counters include the messages sent by
+// the other side, which are not delivered yet, and there are no wire counters.
+func (c *Conn) Stats() syncws.Stats {
+	return syncws.Stats{PayloadRead: c.peer.payloadWritten(), PayloadWritten: c.payloadWritten()}
+}
+
+// Dropped implements device_api.ConnStats. Conn has no queue limits, so it's always zero;
+// see Lost for the messages lost due to Faults.
+func (c *Conn) Dropped(p device_api.Priority) int64 {
+	return 0
+}
+
+func (c *Conn) In() <-chan *device_api.Message {
+	return c.in
+}
+
+func (c *Conn) Send(data string) error {
+	return c.send(&device_api.Message{Type: websocket.TextMessage, Data: []byte(data)})
+}
+
+func (c *Conn) SendBinary(data []byte) error {
+	return c.send(&device_api.Message{Type: websocket.BinaryMessage, Data: append([]byte(nil), data...)})
+}
+
+func (c *Conn) send(msg *device_api.Message) error {
+	if c.Closed() {
+		return device_api.ErrConnClosed
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken {
+		return device_api.ErrConnClosed
+	}
+	c.sent++
+	last := false
+	if c.faults.DisconnectAfter > 0 {
+		c.faults.DisconnectAfter--
+		last = c.faults.DisconnectAfter == 0
+		c.broken = last
+	}
+	if c.faults.DropRate > 0 && c.rnd.Float64() < c.faults.DropRate {
+		c.lost++
+		if last {
+			c.link.close()
+		}
+		return nil
+	}
+	c.written += int64(len(msg.Data))
+	at := time.Now().Add(c.faults.Latency)
+	if c.faults.Jitter > 0 {
+		at = at.Add(time.Duration(c.rnd.Int63n(int64(c.faults.Jitter))))
+	}
+	if at.Before(c.lastAt) {
+		at = c.lastAt
+	}
+	c.lastAt = at
+	c.queue = append(c.queue, &delivery{at: at, msg: msg, last: last})
+	select {
+	case c.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// deliver moves the sent messages to the In() of the peer.
+func (c *Conn) deliver() {
+	defer close(c.peer.in)
+	for {
+		c.mu.Lock()
+		var next *delivery
+		if len(c.queue) > 0 {
+			next = c.queue[0]
+			c.queue[0] = nil
+			c.queue = c.queue[1:]
+		}
+		c.mu.Unlock()
+		if next == nil {
+			select {
+			case <-c.wake:
+				continue
+			case <-c.link.closed:
+				return
+			}
+		}
+		if d := time.Until(next.at); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-c.link.closed:
+				return
+			}
+		}
+		select {
+		case c.peer.in <- next.msg:
+		case <-c.link.closed:
+			return
+		}
+		if next.last {
+			c.link.close()
+			return
+		}
+	}
+}
+
+// Closed reports whether the connection is broken.
+func (c *Conn) Closed() bool {
+	select {
+	case <-c.link.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close breaks the connection. It's fine to call it more than once.
+func (c *Conn) Close() error {
+	c.link.close()
+	return nil
+}
@@ -0,0 +1,166 @@
+package devicetest
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	b.SetFaults(Faults{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond})
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := b.Send(fmt.Sprint(i)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		msg := <-a.In()
+		if got, want := string(msg.Data), fmt.Sprint(i); got != want {
+			t.Fatalf("message #%d: %q, want %q", i, got, want)
+		}
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("the messages were delivered in %v, faster than the latency", d)
+	}
+
+	b.SetFaults(Faults{DropRate: 1})
+	if err := b.Send("lost"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if b.Lost() != 1 || b.Sent() != 101 {
+		t.Errorf("Lost: %d, Sent: %d, want 1 and 101", b.Lost(), b.Sent())
+	}
+	var stats device_api.ConnStats = b
+	if got := stats.Stats().PayloadWritten; got != 190 {
+		// 10 one-digit and 90 two-digit numbers.
+		t.Errorf("PayloadWritten: %d, want 190", got)
+	}
+
+	a.Close()
+	a.Close()
+	if _, ok := <-b.In(); ok {
+		t.Errorf("In() is not closed after the other side closed the connection")
+	}
+	if err := b.Send("late"); err != device_api.ErrConnClosed {
+		t.Errorf("Send after Close: %v, want ErrConnClosed", err)
+	}
+}
+
+func TestDisconnectAfter(t *testing.T) {
+	a, b := Pipe()
+	b.SetFaults(Faults{DisconnectAfter: 2})
+	for _, data := range []string{"1", "2"} {
+		if err := b.Send(data); err != nil {
+			t.Fatalf("Send(%q): %v", data, err)
+		}
+	}
+	if err := b.Send("3"); err != device_api.ErrConnClosed {
+		t.Errorf("Send after DisconnectAfter messages: %v, want ErrConnClosed", err)
+	}
+	var got []string
+	for msg := range a.In() {
+		got = append(got, string(msg.Data))
+	}
+	if len(got) != 2 || got[1] != "2" {
+		t.Errorf("Delivered messages: %q, want both", got)
+	}
+	if !a.Closed() {
+		t.Errorf("The connection is not broken")
+	}
+}
+
+func TestHarness(t *testing.T) {
+	impl := new(FakeImpl)
+	p := StartSession(t, impl, GoodCookie)
+	for i := 0; i < 3; i++ {
+		if err := p.Client.Notify(&device_api.UplinkMessage{Type: "status", JobName: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	msgs, err := impl.WaitNotifications(3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgs[2].JobName != "2" {
+		t.Errorf("the last notification: %+v", msgs[2])
+	}
+	if got := p.Server.Session().DeviceName; got != DeviceName {
+		t.Errorf("device name: %q, want %q", got, DeviceName)
+	}
+
+	impl.OnNotify = func(sess *device_api.Session, msg *device_api.UplinkMessage, resp *device_api.Response) error {
+		return errors.New("no space left on device")
+	}
+	if err := p.Client.Notify(&device_api.UplinkMessage{Type: "status"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if _, err := impl.WaitNotifications(4, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentWaiters(t *testing.T) {
+	impl := new(FakeImpl)
+	p := StartSession(t, impl, GoodCookie)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := impl.WaitNotifications(1, time.Second)
+			errs <- err
+		}()
+	}
+	if err := p.Client.Notify(&device_api.UplinkMessage{Type: "status"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("waiter #%d: %v", i, err)
+		}
+	}
+}
+
+func TestProgrammedHello(t *testing.T) {
+	impl := &FakeImpl{
+		OnHello: func(sess *device_api.Session, cookie, jobName string, resp *device_api.Response) error {
+			resp.Login = &device_api.Login{DeviceName: "printer-" + cookie}
+			return nil
+		},
+	}
+	p := StartSession(t, impl, "42")
+	if got := p.Server.Session().DeviceName; got != "printer-42" {
+		t.Errorf("device name: %q, want printer-42", got)
+	}
+	if impl.Hellos() != 1 {
+		t.Errorf("Hellos: %d, want 1", impl.Hellos())
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	impl := new(FakeImpl)
+	p := StartSession(t, impl, GoodCookie)
+	p.ClientConn.SetFaults(Faults{DisconnectAfter: 2})
+	for i := 0; i < 2; i++ {
+		if err := p.Client.Notify(&device_api.UplinkMessage{Type: "status"}); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	if err := p.Client.Notify(&device_api.UplinkMessage{Type: "status"}); err == nil {
+		t.Errorf("Notify succeeded on a broken connection")
+	}
+	if _, err := impl.WaitNotifications(2, time.Second); err != nil {
+		t.Error(err)
+	}
+	WaitFor(t, time.Second, "the client to stop", func() bool {
+		select {
+		case <-p.Client.Stopped():
+			return true
+		default:
+			return false
+		}
+	})
+}
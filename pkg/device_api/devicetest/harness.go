@@ -0,0 +1,64 @@
+package devicetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+// Pair is a Server and a Client connected with Pipe.
+type Pair struct {
+	Server     *device_api.Server
+	Client     *device_api.Client
+	Node       *pubsub.Node
+	ServerConn *Conn
+	ClientConn *Conn
+
+	done chan bool
+}
+
+// Start runs a Server with impl and connects a Client to it. The pair is closed
+// at the end of the test.
+func Start(t testing.TB, impl device_api.Impl) *Pair {
+	p := &Pair{Node: pubsub.NewNode(), done: make(chan bool)}
+	p.ServerConn, p.ClientConn = Pipe()
+	p.Server = device_api.NewServer(p.ServerConn, impl)
+	go func() {
+		p.Server.Run()
+		close(p.done)
+	}()
+	p.Client = device_api.NewClient(p.ClientConn, p.Node)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// StartSession is like Start, but it also sends hello with the cookie.
+func StartSession(t testing.TB, impl device_api.Impl, cookie string) *Pair {
+	p := Start(t, impl)
+	if _, err := p.Client.Hello(cookie, "" /*jobName*/); err != nil {
+		t.Fatalf("Hello: %v", err)
+	}
+	return p
+}
+
+// Close stops the client and the server, and breaks the connection. It's fine to call it more than once.
+func (p *Pair) Close() {
+	p.Client.Stop()
+	p.ServerConn.Close()
+	<-p.done
+	p.Node.Stop()
+}
+
+// WaitFor polls cond until it's true, and fails the test after the timeout.
+func WaitFor(t testing.TB, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package devicetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+)
+
+const (
+	GoodCookie = "devicetest good cookie"
+	DeviceName = "devicetest-001"
+)
+
+// FakeImpl is a server Impl, which records what the devices send. By default, it accepts
+// GoodCookie in hello, and registers devices with the cookie "<DeviceName> cookie".
+// The responses are programmed with the On* hooks, which are called instead of the default behavior.
+type FakeImpl struct {
+	OnHello          func(sess *device_api.Session, cookie, jobName string, resp *device_api.Response) error
+	OnRegisterDevice func(sess *device_api.Session, cookie string, resp *device_api.Response) error
+	OnNotify         func(sess *device_api.Session, msg *device_api.UplinkMessage, resp *device_api.Response) error
+	OnTerminalOutput func(sess *device_api.Session, batch *device_api.TerminalBatch, resp *device_api.Response) error
+
+	mu       sync.Mutex
+	hellos   int
+	notifies []*device_api.UplinkMessage
+	frames   []*device_api.CameraFrame
+	terminal []*device_api.TerminalBatch
+	// Closed and replaced on every recorded call, so that all the waiters are woken up.
+	changed chan bool
+}
+
+func (f *FakeImpl) changedLocked() chan bool {
+	if f.changed == nil {
+		f.changed = make(chan bool)
+	}
+	return f.changed
+}
+
+// record calls fn with the lock held. The hooks are read in fn, so that the tests may change
+// them between the requests.
+func (f *FakeImpl) record(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+	close(f.changedLocked())
+	f.changed = make(chan bool)
+}
+
+func (f *FakeImpl) Hello(sess *device_api.Session, cookie, jobName string, resp *device_api.Response) error {
+	var hook func(*device_api.Session, string, string, *device_api.Response) error
+	f.record(func() { f.hellos++; hook = f.OnHello })
+	if hook != nil {
+		return hook(sess, cookie, jobName, resp)
+	}
+	if cookie != GoodCookie {
+		return errors.New("bad cookie")
+	}
+	resp.Login = &device_api.Login{DeviceName: DeviceName}
+	return nil
+}
+
+func (f *FakeImpl) RegisterDevice(sess *device_api.Session, cookie string, resp *device_api.Response) error {
+	var hook func(*device_api.Session, string, *device_api.Response) error
+	f.record(func() { hook = f.OnRegisterDevice })
+	if hook != nil {
+		return hook(sess, cookie, resp)
+	}
+	resp.Login = &device_api.Login{Cookie: DeviceName + " cookie"}
+	return nil
+}
+
+func (f *FakeImpl) Notify(sess *device_api.Session, msg *device_api.UplinkMessage, resp *device_api.Response) error {
+	var hook func(*device_api.Session, *device_api.UplinkMessage, *device_api.Response) error
+	f.record(func() { f.notifies = append(f.notifies, msg); hook = f.OnNotify })
+	if hook != nil {
+		return hook(sess, msg, resp)
+	}
+	return nil
+}
+
+func (f *FakeImpl) CameraFrame(sess *device_api.Session, frame *device_api.CameraFrame) error {
+	f.record(func() { f.frames = append(f.frames, frame) })
+	return nil
+}
+
+func (f *FakeImpl) TerminalOutput(sess *device_api.Session, batch *device_api.TerminalBatch, resp *device_api.Response) error {
+	var hook func(*device_api.Session, *device_api.TerminalBatch, *device_api.Response) error
+	f.record(func() { f.terminal = append(f.terminal, batch); hook = f.OnTerminalOutput })
+	if hook != nil {
+		return hook(sess, batch, resp)
+	}
+	return nil
+}
+
+// Hellos returns the number of hello requests.
+func (f *FakeImpl) Hellos() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hellos
+}
+
+// Notifications returns the uplink messages received so far.
+func (f *FakeImpl) Notifications() []*device_api.UplinkMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*device_api.UplinkMessage(nil), f.notifies...)
+}
+
+// Frames returns the camera frames received so far.
+func (f *FakeImpl) Frames() []*device_api.CameraFrame {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*device_api.CameraFrame(nil), f.frames...)
+}
+
+// TerminalBatches returns the terminal output received so far.
+func (f *FakeImpl) TerminalBatches() []*device_api.TerminalBatch {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*device_api.TerminalBatch(nil), f.terminal...)
+}
+
+// WaitNotifications waits until at least n uplink messages are received.
+func (f *FakeImpl) WaitNotifications(n int, timeout time.Duration) ([]*device_api.UplinkMessage, error) {
+	deadline := time.After(timeout)
+	for {
+		f.mu.Lock()
+		got, ch := len(f.notifies), f.changedLocked()
+		f.mu.Unlock()
+		if got >= n {
+			return f.Notifications(), nil
+		}
+		select {
+		case <-ch:
+		case <-deadline:
+			return f.Notifications(), fmt.Errorf("timed out waiting for %d notifications, got %d", n, got)
+		}
+	}
+}
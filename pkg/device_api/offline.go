@@ -0,0 +1,358 @@
+package device_api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the client waits for the server to acknowledge a message from the offline queue.
+const offlineAckTimeout = 30 * time.Second
+
+type OfflineQueueOptions struct {
+	// The total size of the queued messages. The oldest messages are dropped to make room for new ones.
+	MaxBytes int64
+	// Older messages are dropped.
+	MaxAge time.Duration
+}
+
+var DefaultOfflineQueueOptions = OfflineQueueOptions{
+	MaxBytes: 16 << 20,
+	MaxAge:   24 * time.Hour,
+}
+
+type offlineEntry struct {
+	seq  uint64
+	size int64
+	msg  *UplinkMessage
+}
+
+// OfflineQueue is a durable queue of uplink messages, which could not be sent while the device
+// was offline. Every message is saved to its own file <seq>.json in the directory, so that
+// the queue survives restarts of the agent.
+type OfflineQueue struct {
+	dir  string
+	opts OfflineQueueOptions
+
+	mu      sync.Mutex
+	entries []*offlineEntry
+	size    int64
+	nextSeq uint64
+}
+
+// OpenOfflineQueue loads the messages left in dir by the previous run, if any.
+func OpenOfflineQueue(dir string, opts OfflineQueueOptions) (*OfflineQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	q := &OfflineQueue{dir: dir, opts: opts, nextSeq: 1}
+	names, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read a queued message: %v", err)
+		}
+		var msg UplinkMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			logger.Warn("Dropping a corrupted queued message", "file", name, "err", err)
+			os.Remove(name)
+			continue
+		}
+		q.entries = append(q.entries, &offlineEntry{seq: seq, size: int64(len(data)), msg: &msg})
+		q.size += int64(len(data))
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+	sort.Slice(q.entries, func(i, j int) bool { return q.entries[i].seq < q.entries[j].seq })
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expireLocked(time.Now())
+	return q, nil
+}
+
+func (q *OfflineQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", seq))
+}
+
+// coalescable reports whether msg is a plain status update, which is superseded by the next one.
+func coalescable(msg *UplinkMessage) bool {
+	return msg.JobEvent == nil && msg.TerminalOutput == "" && len(msg.Cameras) == 0
+}
+
+// Push saves the message to the end of the queue. If both the message and the last queued one
+// are plain status updates of the same type and job, the last one is replaced.
+func (q *OfflineQueue) Push(msg *UplinkMessage) error {
+	if msg.ID == "" || msg.CreatedAt == 0 {
+		m := *msg
+		if m.ID == "" {
+			m.ID = newMessageID()
+		}
+		if m.CreatedAt == 0 {
+			m.CreatedAt = time.Now().UnixNano() / int64(time.Millisecond)
+		}
+		msg = &m
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal a message: %v", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expireLocked(time.Now())
+
+	seq := q.nextSeq
+	var replaced *offlineEntry
+	if n := len(q.entries); n > 0 {
+		last := q.entries[n-1].msg
+		if coalescable(last) && coalescable(msg) && last.Type == msg.Type && last.JobName == msg.JobName {
+			replaced = q.entries[n-1]
+			seq = replaced.seq
+		}
+	}
+	tmp := q.path(seq) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save a message: %v", err)
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		return fmt.Errorf("failed to save a message: %v", err)
+	}
+	entry := &offlineEntry{seq: seq, size: int64(len(data)), msg: msg}
+	if replaced != nil {
+		q.size -= replaced.size
+		q.entries[len(q.entries)-1] = entry
+	} else {
+		q.nextSeq++
+		q.entries = append(q.entries, entry)
+	}
+	q.size += entry.size
+	for q.opts.MaxBytes > 0 && q.size > q.opts.MaxBytes && len(q.entries) > 1 {
+		logger.Warn("Offline queue is full, dropping the oldest message", "maxBytes", q.opts.MaxBytes)
+		q.removeFrontLocked()
+	}
+	return nil
+}
+
+func (q *OfflineQueue) removeFrontLocked() {
+	e := q.entries[0]
+	q.entries[0] = nil
+	q.entries = q.entries[1:]
+	q.size -= e.size
+	if err := os.Remove(q.path(e.seq)); err != nil {
+		logger.Warn("Failed to remove a queued message", "err", err)
+	}
+}
+
+func (q *OfflineQueue) expireLocked(now time.Time) {
+	if q.opts.MaxAge <= 0 {
+		return
+	}
+	minCreatedAt := now.Add(-q.opts.MaxAge).UnixNano() / int64(time.Millisecond)
+	for len(q.entries) > 0 && q.entries[0].msg.CreatedAt < minCreatedAt {
+		q.removeFrontLocked()
+	}
+}
+
+// Len returns the number of queued messages.
+func (q *OfflineQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// Peek returns the first message in the queue.
+func (q *OfflineQueue) Peek() (*UplinkMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.expireLocked(time.Now())
+	if len(q.entries) == 0 {
+		return nil, false
+	}
+	return q.entries[0].msg, true
+}
+
+// Remove deletes the first message, if it's the one returned by Peek.
+func (q *OfflineQueue) Remove(msg *UplinkMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.entries) > 0 && q.entries[0].msg == msg {
+		q.removeFrontLocked()
+	}
+}
+
+func newMessageID() string {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Not unique, but good enough to keep going.
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// SetOfflineQueue makes Notify save the messages to q, while they can't be sent: before Hello,
+// when the connection fails, or while older messages are still queued. The queued messages
+// are resent in order after Hello.
+func (c *Client) SetOfflineQueue(q *OfflineQueue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offline = q
+}
+
+// queueOffline returns true, if the message must go to the offline queue instead of the connection.
+func (c *Client) queueOffline() (*OfflineQueue, bool) {
+	c.mu.Lock()
+	q, online := c.offline, c.protocolVersion != 0
+	c.mu.Unlock()
+	if q == nil {
+		return nil, false
+	}
+	return q, !online || q.Len() > 0
+}
+
+// startOfflineFlush starts flushOffline, unless it's already running, or there was no Hello yet.
+func (c *Client) startOfflineFlush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.offline == nil || c.flushing || c.protocolVersion == 0 {
+		return
+	}
+	c.flushing = true
+	go c.flushOffline(c.offline)
+}
+
+// flushOffline sends the queued messages one by one. If the server supports acks, a message is
+// removed from the queue only after the server has acknowledged it. Otherwise, the delivery
+// is best effort.
+func (c *Client) flushOffline(q *OfflineQueue) {
+	for {
+		msg, ok := q.Peek()
+		if !ok {
+			// Notify kicks the flusher after a Push, but only if it's not running,
+			// so check again while holding the lock.
+			c.mu.Lock()
+			empty := q.Len() == 0
+			if empty {
+				c.flushing = false
+			}
+			c.mu.Unlock()
+			if empty {
+				return
+			}
+			continue
+		}
+		withAcks := c.HasCapability(CapUplinkAcks)
+		ch := make(chan bool, 1)
+		c.mu.Lock()
+		if c.uplinkAcks == nil {
+			c.uplinkAcks = make(map[string]chan bool)
+		}
+		c.uplinkAcks[msg.ID] = ch
+		c.mu.Unlock()
+		err := c.sendNotify(msg)
+		if err == nil && withAcks {
+			select {
+			case <-ch:
+			case <-c.stopped:
+				err = errors.New("client is stopped")
+			case <-time.After(offlineAckTimeout):
+				err = errors.New("timed out waiting for an ack")
+			}
+		}
+		c.mu.Lock()
+		delete(c.uplinkAcks, msg.ID)
+		c.mu.Unlock()
+		if err != nil {
+			logger.Warn("Failed to send a queued message, will retry after the next hello", "err", err)
+			c.mu.Lock()
+			c.flushing = false
+			c.mu.Unlock()
+			return
+		}
+		q.Remove(msg)
+	}
+}
+
+// handleUplinkAck routes the acks for uplink messages to flushOffline.
+func (c *Client) handleUplinkAck(id string) {
+	c.mu.Lock()
+	ch := c.uplinkAcks[id]
+	c.mu.Unlock()
+	if ch != nil {
+		select {
+		case ch <- true:
+		default:
+		}
+	}
+}
+
+// Dedup remembers the IDs of recent uplink messages of every device, so that the messages
+// resent from the offline queue after a reconnect are handled only once. A single Dedup
+// must be shared by all servers.
+type Dedup struct {
+	size int
+
+	mu      sync.Mutex
+	devices map[string]*dedupRing
+}
+
+type dedupRing struct {
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+// NewDedup returns a Dedup, which remembers up to size IDs per device.
+func NewDedup(size int) *Dedup {
+	return &Dedup{size: size, devices: make(map[string]*dedupRing)}
+}
+
+// Seen reports whether the message was already handled.
+func (d *Dedup) Seen(deviceName, id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.devices[deviceName]
+	return ok && r.ids[id]
+}
+
+// Add remembers the message as handled. Call it only after the message was handled successfully.
+func (d *Dedup) Add(deviceName, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	r, ok := d.devices[deviceName]
+	if !ok {
+		r = &dedupRing{ids: make(map[string]bool), order: make([]string, d.size)}
+		d.devices[deviceName] = r
+	}
+	if r.ids[id] || d.size == 0 {
+		return
+	}
+	delete(r.ids, r.order[r.next])
+	r.order[r.next] = id
+	r.ids[id] = true
+	r.next = (r.next + 1) % d.size
+}
+
+// SetDedup makes the server skip the uplink messages seen by d. The messages are acknowledged regardless.
+// A message is added to d only after Impl.Notify succeeds, so the device resends the failed ones.
+func (srv *Server) SetDedup(d *Dedup) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.dedup = d
+}
@@ -0,0 +1,237 @@
+package device_api
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrQueueFull       = errors.New("outbound queue is full")
+	ErrConnClosed      = errors.New("connection is closed")
+	ErrMessageTooLarge = errors.New("message is larger than the outbound queue")
+)
+
+// Priority is the class of an outbound message. Messages of a higher class are always sent first.
+type Priority int
+
+const (
+	// Hello, acks, downlink commands, errors and the messages sent with plain Send.
+	PriorityControl Priority = iota
+	// Notify and the replies to it.
+	PriorityStatus
+	// Terminal output and file transfers, which must not be lost.
+	PriorityTransfer
+	// Camera frames.
+	PriorityBulk
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "control"
+	case PriorityStatus:
+		return "status"
+	case PriorityTransfer:
+		return "transfer"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return "unknown"
+}
+
+// DropPolicy says what happens when a message does not fit into the queue of its class.
+type DropPolicy int
+
+const (
+	// The message is not queued, and Send returns ErrQueueFull.
+	DropNone DropPolicy = iota
+	// The oldest queued messages are dropped to make room for the new one.
+	DropOldest
+	// The new message is silently dropped.
+	DropNewest
+)
+
+// QueueClass limits the queue of one priority class. Zero limits mean no limit. A message
+// larger than MaxBytes is never queued: Send returns ErrMessageTooLarge.
+type QueueClass struct {
+	MaxMessages int
+	MaxBytes    int
+	Drop        DropPolicy
+}
+
+// QueueOptions configure the outbound queue of WSConn, indexed by Priority.
+type QueueOptions struct {
+	Classes [numPriorities]QueueClass
+}
+
+var DefaultQueueOptions = QueueOptions{
+	Classes: [numPriorities]QueueClass{
+		PriorityControl: {MaxMessages: 256, Drop: DropNone},
+		// A fresh status supersedes the old ones.
+		PriorityStatus:   {MaxMessages: 64, MaxBytes: 1 << 20, Drop: DropOldest},
+		PriorityTransfer: {MaxMessages: 64, MaxBytes: 8 << 20, Drop: DropNone},
+		PriorityBulk:     {MaxMessages: 32, MaxBytes: 8 << 20, Drop: DropOldest},
+	},
+}
+
+// PriorityConn is implemented by connections with an outbound queue.
+// send uses it to pass the priority of the message.
+type PriorityConn interface {
+	SendPriority(p Priority, data string) error
+}
+
+// priorityOf classifies the messages sent with send.
+func priorityOf(obj interface{}) Priority {
+	switch v := obj.(type) {
+	case *Request:
+		switch v.Cmd {
+		case "notify":
+			// Job lifecycle events must not be superseded by progress updates.
+			if v.Msg != nil && v.Msg.JobEvent != nil {
+				return PriorityControl
+			}
+			return PriorityStatus
+		case "terminal":
+			return PriorityTransfer
+		}
+	case *Response:
+		if v.Ack != nil {
+			// The device resends the messages which are not acknowledged.
+			return PriorityControl
+		}
+		if v.Command == nil && v.Login == nil && v.Pairing == nil && v.Status == StatusOK {
+			return PriorityStatus
+		}
+		if v.Command != nil && v.Command.Chunk != nil {
+			return PriorityTransfer
+		}
+	}
+	return PriorityControl
+}
+
+// binaryPriority classifies the binary messages by their kind.
+func binaryPriority(data []byte) Priority {
+	if len(data) > 0 && data[0] == binaryKindFileChunk {
+		return PriorityTransfer
+	}
+	return PriorityBulk
+}
+
+type outMessage struct {
+	typ  int
+	data []byte
+}
+
+type outQueue struct {
+	msgs  []*outMessage
+	bytes int
+}
+
+func (q *outQueue) fits(class QueueClass, size int) bool {
+	return (class.MaxMessages == 0 || len(q.msgs) < class.MaxMessages) &&
+		(class.MaxBytes == 0 || q.bytes+size <= class.MaxBytes)
+}
+
+func (q *outQueue) popFront() *outMessage {
+	msg := q.msgs[0]
+	q.msgs[0] = nil
+	q.msgs = q.msgs[1:]
+	q.bytes -= len(msg.data)
+	return msg
+}
+
+// outQueues is a set of bounded queues, one per priority class.
+type outQueues struct {
+	opts QueueOptions
+
+	mu      sync.Mutex
+	queues  [numPriorities]outQueue
+	dropped [numPriorities]int64
+	closed  bool
+	// Gets a value, when a message is pushed or the queues are closed.
+	wake chan bool
+}
+
+func newOutQueues(opts QueueOptions) *outQueues {
+	return &outQueues{opts: opts, wake: make(chan bool, 1)}
+}
+
+func (oq *outQueues) push(p Priority, msg *outMessage) error {
+	if p < 0 || p >= numPriorities {
+		return fmt.Errorf("invalid priority %d", p)
+	}
+	oq.mu.Lock()
+	defer oq.mu.Unlock()
+	if oq.closed {
+		return ErrConnClosed
+	}
+	class := oq.opts.Classes[p]
+	if class.MaxBytes > 0 && len(msg.data) > class.MaxBytes {
+		return ErrMessageTooLarge
+	}
+	q := &oq.queues[p]
+	for !q.fits(class, len(msg.data)) {
+		switch class.Drop {
+		case DropOldest:
+			q.popFront()
+			oq.dropped[p]++
+		case DropNone:
+			return ErrQueueFull
+		default:
+			oq.dropped[p]++
+			return nil
+		}
+	}
+	q.msgs = append(q.msgs, msg)
+	q.bytes += len(msg.data)
+	oq.signal()
+	return nil
+}
+
+func (oq *outQueues) signal() {
+	select {
+	case oq.wake <- true:
+	default:
+	}
+}
+
+// pop returns the first message of the highest priority class. It returns nil, if the queues
+// are empty. The messages queued before close are still returned.
+func (oq *outQueues) pop() (msg *outMessage, closed bool) {
+	oq.mu.Lock()
+	defer oq.mu.Unlock()
+	for p := range oq.queues {
+		if len(oq.queues[p].msgs) > 0 {
+			return oq.queues[p].popFront(), false
+		}
+	}
+	return nil, oq.closed
+}
+
+// wait blocks until there's a message to send. It returns nil, when the queues are closed and empty.
+func (oq *outQueues) wait() *outMessage {
+	for {
+		msg, closed := oq.pop()
+		if msg != nil || closed {
+			return msg
+		}
+		<-oq.wake
+	}
+}
+
+// close makes push fail. The queued messages are still returned by pop and wait.
+func (oq *outQueues) close() {
+	oq.mu.Lock()
+	defer oq.mu.Unlock()
+	oq.closed = true
+	oq.signal()
+}
+
+func (oq *outQueues) droppedCount(p Priority) int64 {
+	oq.mu.Lock()
+	defer oq.mu.Unlock()
+	return oq.dropped[p]
+}
@@ -0,0 +1,314 @@
+package device_api
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+// PairingCodeTTL is how long the user has to confirm a pairing code.
+const PairingCodeTTL = 10 * time.Minute
+
+var (
+	ErrUnknownPairingCode = errors.New("unknown or expired pairing code")
+	ErrPairingExpired     = errors.New("pairing code expired")
+)
+
+// Pairing is a short code displayed on the device, which the user confirms from the operator side.
+// It's an alternative to RegisterDevice, which does not need the user cookie on the device.
+type Pairing struct {
+	Code string `json:"code,omitempty"`
+	// Unix time in seconds.
+	Expires int64 `json:"expires,omitempty"`
+	// Set, if the pairing failed. Unlike Response.Error, it can't be confused with the reply
+	// to another command.
+	Error string `json:"error,omitempty"`
+}
+
+// PairingStore keeps pairing codes until they are confirmed by the user or expire.
+// The device connection and the user confirming the code might be handled by different
+// processes, so persistent implementations must share the state between them.
+type PairingStore interface {
+	// Create returns a new unique pairing code.
+	Create(expires time.Time) (code string, err error)
+	// Confirm is called on the operator side with the cookie of the user, who owns the device.
+	Confirm(code, userCookie string) error
+	// Wait blocks until the code is confirmed, and returns the user cookie passed to Confirm.
+	Wait(ctx context.Context, code string) (userCookie string, err error)
+	// Delete forgets the code. It's called after the pairing is complete or failed.
+	Delete(code string) error
+}
+
+// The alphabet has no characters which are easy to confuse, like 0 and O, or 1 and I.
+const pairingAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// NewPairingCode returns a random code like "K7QD-M2XA".
+func NewPairingCode() (string, error) {
+	var sb strings.Builder
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			sb.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(pairingAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(pairingAlphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// normalizePairingCode makes "k7qd m2xa" and "K7QD-M2XA" the same, as users type codes in any way.
+func normalizePairingCode(code string) string {
+	code = strings.ToUpper(strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+type memPairing struct {
+	expires time.Time
+	// Closed on confirmation.
+	confirmed   chan bool
+	isConfirmed bool
+	userCookie  string
+}
+
+// MemPairingStore is an in-memory PairingStore. It's enough for a single server process and for tests.
+type MemPairingStore struct {
+	mu    sync.Mutex
+	codes map[string]*memPairing
+}
+
+func NewMemPairingStore() *MemPairingStore {
+	return &MemPairingStore{codes: make(map[string]*memPairing)}
+}
+
+func (st *MemPairingStore) Create(expires time.Time) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for code, p := range st.codes {
+		if now.After(p.expires) {
+			delete(st.codes, code)
+		}
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		code, err := NewPairingCode()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := st.codes[code]; ok {
+			continue
+		}
+		st.codes[code] = &memPairing{expires: expires, confirmed: make(chan bool)}
+		return code, nil
+	}
+	return "", errors.New("failed to generate a unique pairing code")
+}
+
+func (st *MemPairingStore) Confirm(code, userCookie string) error {
+	if userCookie == "" {
+		return errors.New("user cookie is empty")
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	p, ok := st.codes[normalizePairingCode(code)]
+	if !ok || time.Now().After(p.expires) {
+		return ErrUnknownPairingCode
+	}
+	if p.isConfirmed {
+		return errors.New("pairing code is already confirmed")
+	}
+	p.isConfirmed = true
+	p.userCookie = userCookie
+	close(p.confirmed)
+	return nil
+}
+
+func (st *MemPairingStore) Wait(ctx context.Context, code string) (string, error) {
+	st.mu.Lock()
+	p, ok := st.codes[code]
+	st.mu.Unlock()
+	if !ok {
+		return "", ErrUnknownPairingCode
+	}
+	timer := time.NewTimer(time.Until(p.expires))
+	defer timer.Stop()
+	select {
+	case <-p.confirmed:
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		return p.userCookie, nil
+	case <-timer.C:
+		return "", ErrPairingExpired
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (st *MemPairingStore) Delete(code string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.codes, code)
+	return nil
+}
+
+// SetPairingStore enables the "pair" command. Confirmed codes are exchanged for a device cookie
+// with Impl.RegisterDevice, called with the cookie of the user who confirmed the code.
+func (srv *Server) SetPairingStore(st PairingStore) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.pairing = st
+}
+
+// pair creates a pairing code and waits for its confirmation in the background. A connection
+// may only have a single pending pairing, as "pair" does not require authentication.
+func (srv *Server) pair(sess *Session) {
+	srv.mu.Lock()
+	st, pending := srv.pairing, srv.pairingPending
+	if st != nil && !pending {
+		srv.pairingPending = true
+	}
+	srv.mu.Unlock()
+	if st == nil {
+		srv.replyPairingError("pairing is not supported")
+		return
+	}
+	if pending {
+		srv.replyPairingError("pairing is already in progress")
+		return
+	}
+	done := func() {
+		srv.mu.Lock()
+		srv.pairingPending = false
+		srv.mu.Unlock()
+	}
+	expires := time.Now().Add(PairingCodeTTL)
+	code, err := st.Create(expires)
+	if err != nil {
+		done()
+		logger.Error("Backend error", "err", fmt.Errorf("failed to create a pairing code: %v", err))
+		srv.replyPairingError("backend error")
+		return
+	}
+	err = send(srv.conn, &Response{
+		Status:  StatusOK,
+		Pairing: &Pairing{Code: code, Expires: expires.Unix()},
+	})
+	if err != nil {
+		logger.Warn("Failed to send a pairing code", "err", err)
+		st.Delete(code)
+		done()
+		return
+	}
+	// Waiting for the user must not block other commands from the device.
+	go func() {
+		defer done()
+		defer st.Delete(code)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-srv.stopped:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		userCookie, err := st.Wait(ctx, code)
+		if err == ErrPairingExpired {
+			srv.replyPairingError("pairing code expired")
+			return
+		}
+		if err != nil {
+			logger.Warn("Pairing failed", "code", code, "err", err)
+			return
+		}
+		var resp Response
+		if err := srv.impl.RegisterDevice(sess, userCookie, &resp); err != nil {
+			logger.Error("Backend error", "err", err)
+			srv.replyPairingError("backend error")
+			return
+		}
+		resp.Status = StatusOK
+		if err := send(srv.conn, &resp); err != nil {
+			logger.Warn("Failed to send a response", "err", err)
+		}
+	}()
+}
+
+// replyPairingError replies to "pair" with an error, which is also set in Pairing.Error.
+func (srv *Server) replyPairingError(userMessage string) {
+	err := send(srv.conn, &Response{
+		Status:  StatusError,
+		Error:   userMessage,
+		Pairing: &Pairing{Error: userMessage},
+	})
+	if err != nil {
+		logger.Warn("replyPairingError failed", "userMessage", userMessage, "err", err)
+	}
+}
+
+// Pair registers the device without the user cookie. The server replies with a pairing code,
+// which is passed to display, so that the agent can show it to the user. Once the user
+// confirms the code from the operator side, the server issues the device cookie.
+func (c *Client) Pair(ctx context.Context, display func(code string, expires time.Time)) (deviceCookie string, err error) {
+	var subs []*pubsub.ValueSub
+	defer func() {
+		for _, sub := range subs {
+			sub.Unsub()
+		}
+	}()
+	for _, path := range []string{"pairing.code", "pairing.expires", "login.cookie", "pairing.error"} {
+		sub, err := c.nd.SubValue(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to subscribe for %s: %v", path, err)
+		}
+		subs = append(subs, sub)
+	}
+	codeSub, expiresSub, cookieSub, errSub := subs[0], subs[1], subs[2], subs[3]
+	// Skip the values left from the previous commands.
+	c.nd.Flush()
+	for _, sub := range subs {
+		lastValue(sub)
+	}
+
+	if err := send(c.conn, &Request{Cmd: "pair"}); err != nil {
+		return "", fmt.Errorf("failed to send pair: %v", err)
+	}
+	select {
+	case v := <-codeSub.C():
+		code, _ := v.(string)
+		// The expiration comes in the same update as the code.
+		c.nd.Flush()
+		v, _ = lastValue(expiresSub)
+		fexpires, _ := v.(float64)
+		display(code, time.Unix(int64(fexpires), 0))
+	case v := <-errSub.C():
+		return "", fmt.Errorf("pairing failed: %v", v)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	select {
+	case v := <-cookieSub.C():
+		deviceCookie, _ = v.(string)
+		return deviceCookie, nil
+	case v := <-errSub.C():
+		return "", fmt.Errorf("pairing failed: %v", v)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
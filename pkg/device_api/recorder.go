@@ -0,0 +1,307 @@
+package device_api
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/robodone/robosla-common/pkg/syncws"
+)
+
+// Direction of a recorded message, relative to the side which recorded it.
+const (
+	DirIn  = "in"
+	DirOut = "out"
+)
+
+// Kinds of recorded messages.
+const (
+	KindText   = "text"
+	KindBinary = "binary"
+)
+
+// RecordedMessage is a line of a session recording.
+type RecordedMessage struct {
+	Time time.Time `json:"t"`
+	Dir  string    `json:"dir"`
+	// KindText or KindBinary. Older recordings don't have it: a message is binary, if Binary is set.
+	Kind   string `json:"kind,omitempty"`
+	Text   string `json:"text,omitempty"`
+	Binary []byte `json:"binary,omitempty"`
+	// Set, if the message could not be sent.
+	Err string `json:"err,omitempty"`
+}
+
+func (rm *RecordedMessage) message() *Message {
+	if rm.Kind == KindBinary || rm.Kind == "" && rm.Binary != nil {
+		return &Message{Type: websocket.BinaryMessage, Data: rm.Binary}
+	}
+	return &Message{Type: websocket.TextMessage, Data: []byte(rm.Text)}
+}
+
+func recordedMessage(dir string, msg *Message) *RecordedMessage {
+	rm := &RecordedMessage{Time: time.Now(), Dir: dir}
+	if msg.Type == websocket.BinaryMessage {
+		rm.Kind = KindBinary
+		rm.Binary = msg.Data
+	} else {
+		rm.Kind = KindText
+		rm.Text = string(msg.Data)
+	}
+	return rm
+}
+
+// ReadRecording parses a session recording written by RecordingConn.
+func ReadRecording(r io.Reader) ([]*RecordedMessage, error) {
+	var res []*RecordedMessage
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rm RecordedMessage
+		if err := json.Unmarshal(sc.Bytes(), &rm); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		res = append(res, &rm)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read a recording: %v", err)
+	}
+	return res, nil
+}
+
+// ReadRecordingFile is ReadRecording from a file.
+func ReadRecordingFile(path string) ([]*RecordedMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadRecording(f)
+}
+
+// RecordingConn writes every message received and sent through conn as a JSON line to w,
+// for debugging and replaying the session later. Note that the recording is not redacted:
+// it contains cookies and camera frames.
+type RecordingConn struct {
+	conn Conn
+	inCh chan *Message
+	// Closed by Close, so that run does not block on In(), which nobody reads anymore.
+	done chan bool
+
+	mu     sync.Mutex
+	enc    *json.Encoder
+	w      io.Writer
+	closed bool
+}
+
+func NewRecordingConn(conn Conn, w io.Writer) *RecordingConn {
+	rc := &RecordingConn{
+		conn: conn,
+		inCh: make(chan *Message, backlogSize),
+		done: make(chan bool),
+		enc:  json.NewEncoder(w),
+		w:    w,
+	}
+	go rc.run()
+	return rc
+}
+
+// RecordToFile wraps conn with a RecordingConn, appending to the file at path.
+// The file is closed with the connection.
+func RecordToFile(conn Conn, path string) (*RecordingConn, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a recording: %v", err)
+	}
+	return NewRecordingConn(conn, f), nil
+}
+
+func (rc *RecordingConn) run() {
+	defer close(rc.inCh)
+	for msg := range rc.conn.In() {
+		rc.record(recordedMessage(DirIn, msg))
+		select {
+		case <-rc.done:
+			return
+		default:
+		}
+		select {
+		case rc.inCh <- msg:
+		case <-rc.done:
+			return
+		}
+	}
+}
+
+func (rc *RecordingConn) record(rm *RecordedMessage) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return
+	}
+	if err := rc.enc.Encode(rm); err != nil {
+		logger.Warn("Failed to record a message", "err", err)
+	}
+}
+
+func (rc *RecordingConn) recordOut(msg *Message, err error) {
+	rm := recordedMessage(DirOut, msg)
+	if err != nil {
+		rm.Err = err.Error()
+	}
+	rc.record(rm)
+}
+
+func (rc *RecordingConn) In() <-chan *Message {
+	return rc.inCh
+}
+
+func (rc *RecordingConn) Send(data string) error {
+	err := rc.conn.Send(data)
+	rc.recordOut(&Message{Type: websocket.TextMessage, Data: []byte(data)}, err)
+	return err
+}
+
+// SendPriority passes the priority to conn, if it supports priorities.
+func (rc *RecordingConn) SendPriority(p Priority, data string) error {
+	var err error
+	if pc, ok := rc.conn.(PriorityConn); ok {
+		err = pc.SendPriority(p, data)
+	} else {
+		err = rc.conn.Send(data)
+	}
+	rc.recordOut(&Message{Type: websocket.TextMessage, Data: []byte(data)}, err)
+	return err
+}
+
+func (rc *RecordingConn) SendBinary(data []byte) error {
+	err := rc.conn.SendBinary(data)
+	rc.recordOut(&Message{Type: websocket.BinaryMessage, Data: append([]byte(nil), data...)}, err)
+	return err
+}
+
+// Err, RTT, Stats and Dropped implement ConnStats by forwarding to conn.
+func (rc *RecordingConn) Err() error               { return statsOf(rc.conn).Err() }
+func (rc *RecordingConn) RTT() time.Duration       { return statsOf(rc.conn).RTT() }
+func (rc *RecordingConn) Stats() syncws.Stats      { return statsOf(rc.conn).Stats() }
+func (rc *RecordingConn) Dropped(p Priority) int64 { return statsOf(rc.conn).Dropped(p) }
+
+// Close closes conn and stops recording. If w is an io.Closer, it's closed too.
+func (rc *RecordingConn) Close() error {
+	err := rc.conn.Close()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.closed {
+		return err
+	}
+	rc.closed = true
+	close(rc.done)
+	if c, ok := rc.w.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// ReplayConn is a Conn which feeds the messages of a recording into a Server or a Client,
+// and records what they send back.
+type ReplayConn struct {
+	inCh    chan *Message
+	done    chan bool
+	stopped chan bool
+	once    sync.Once
+
+	mu   sync.Mutex
+	sent []*RecordedMessage
+}
+
+// NewReplayConn delivers the recorded messages with the direction dir to In(). Normally, dir is DirIn,
+// i.e. the recording was made on the same side as the one being replayed. The original pauses
+// between the messages are divided by speed. If speed is zero, the messages are delivered at once.
+func NewReplayConn(recording []*RecordedMessage, dir string, speed float64) *ReplayConn {
+	rc := &ReplayConn{
+		inCh:    make(chan *Message),
+		done:    make(chan bool),
+		stopped: make(chan bool),
+	}
+	var msgs []*RecordedMessage
+	for _, rm := range recording {
+		if rm.Dir == dir {
+			msgs = append(msgs, rm)
+		}
+	}
+	go rc.run(msgs, speed)
+	return rc
+}
+
+func (rc *ReplayConn) run(msgs []*RecordedMessage, speed float64) {
+	defer close(rc.inCh)
+	for i, rm := range msgs {
+		if i > 0 && speed > 0 {
+			pause := time.Duration(float64(rm.Time.Sub(msgs[i-1].Time)) / speed)
+			select {
+			case <-time.After(pause):
+			case <-rc.stopped:
+				return
+			}
+		}
+		select {
+		case rc.inCh <- rm.message():
+		case <-rc.stopped:
+			return
+		}
+	}
+	close(rc.done)
+	// In() is closed only by Close, so that the replies to the last message are not lost.
+	<-rc.stopped
+}
+
+// Done is closed, when all the messages were delivered.
+func (rc *ReplayConn) Done() <-chan bool {
+	return rc.done
+}
+
+// Sent returns the messages sent to the connection so far.
+func (rc *ReplayConn) Sent() []*RecordedMessage {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]*RecordedMessage(nil), rc.sent...)
+}
+
+func (rc *ReplayConn) In() <-chan *Message {
+	return rc.inCh
+}
+
+func (rc *ReplayConn) Send(data string) error {
+	return rc.record(&Message{Type: websocket.TextMessage, Data: []byte(data)})
+}
+
+func (rc *ReplayConn) SendBinary(data []byte) error {
+	return rc.record(&Message{Type: websocket.BinaryMessage, Data: append([]byte(nil), data...)})
+}
+
+func (rc *ReplayConn) record(msg *Message) error {
+	select {
+	case <-rc.stopped:
+		return ErrConnClosed
+	default:
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.sent = append(rc.sent, recordedMessage(DirOut, msg))
+	return nil
+}
+
+func (rc *ReplayConn) Close() error {
+	rc.once.Do(func() { close(rc.stopped) })
+	return nil
+}
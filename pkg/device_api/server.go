@@ -3,28 +3,103 @@ package device_api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/robodone/robosla-common/pkg/job"
 )
 
+// Impl handles the commands sent by a device. Every method gets a copy of the session
+// of the connection; only RegisterDevice and Hello are called before the session is authenticated.
 type Impl interface {
-	RegisterDevice(cookie string, resp *Response) error
-	Hello(cookie, jobName string, resp *Response) error
-	Notify(msg *UplinkMessage, resp *Response) error
+	RegisterDevice(sess *Session, cookie string, resp *Response) error
+	Hello(sess *Session, cookie, jobName string, resp *Response) error
+	Notify(sess *Session, msg *UplinkMessage, resp *Response) error
+}
+
+// CameraFrameImpl is implemented by Impls which want to be notified about camera frames.
+// The frames are saved to Server.Frames() regardless.
+type CameraFrameImpl interface {
+	CameraFrame(sess *Session, frame *CameraFrame) error
+}
+
+// TerminalImpl is implemented by Impls which support terminal output streaming.
+type TerminalImpl interface {
+	TerminalOutput(sess *Session, batch *TerminalBatch, resp *Response) error
 }
 
 type Server struct {
 	conn    Conn
 	impl    Impl
+	frames  *FrameStore
 	stopped chan bool
+
+	mu sync.Mutex
+	// Downlink commands waiting for an ack, by ID.
+	pending map[string]chan *Ack
+	cmdCnt  int64
+	caps    []string
+	auth    Authenticator
+	pairing PairingStore
+	// Whether a pairing code of this connection is waiting for confirmation.
+	pairingPending bool
+	// Nil until a successful hello.
+	session *Session
+	binary  binaryHandlers
+	dedup   *Dedup
+	jobs    *job.Tracker
 }
 
 func NewServer(conn Conn, impl Impl) *Server {
-	srv := &Server{conn: conn, impl: impl, stopped: make(chan bool)}
+	srv := &Server{
+		conn:    conn,
+		impl:    impl,
+		frames:  NewFrameStore(),
+		stopped: make(chan bool),
+		pending: make(map[string]chan *Ack),
+		caps:    DefaultCapabilities,
+	}
+	srv.binary.set(binaryKindCameraFrame, ServerBinaryHandler(srv.handleCameraFrame))
 	return srv
 }
 
+// SetCapabilities sets the features announced to agents in the response to hello.
+// DefaultCapabilities, if not called.
+func (srv *Server) SetCapabilities(caps ...string) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.caps = caps
+}
+
+// SetJobTracker makes the server check the job events against the lifecycle of the jobs
+// in t before passing them to Impl. A single Tracker must be shared by all servers.
+func (srv *Server) SetJobTracker(t *job.Tracker) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.jobs = t
+}
+
+// Agent returns the info about the agent, sent in hello. It's nil before hello, or if the agent is too old.
+func (srv *Server) Agent() *AgentInfo {
+	return srv.Session().Agent
+}
+
+// HasCapability reports whether both the server and the agent support the feature.
+func (srv *Server) HasCapability(capability string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.session == nil || srv.session.Agent == nil {
+		return false
+	}
+	return hasCapability(srv.caps, capability) && hasCapability(srv.session.Agent.Capabilities, capability)
+}
+
+// Frames returns the latest camera frames received from the device.
+func (srv *Server) Frames() *FrameStore {
+	return srv.frames
+}
+
 func (srv *Server) SendBack(resp *Response) error {
 	return send(srv.conn, resp)
 }
@@ -38,31 +113,91 @@ func (srv *Server) Run() error {
 			if !ok {
 				return nil
 			}
-			if msg.Type != websocket.TextMessage {
-				log.Printf("Unexpected message type %d, ignoring...", msg.Type)
+			if msg.Type == websocket.BinaryMessage {
+				srv.handleBinary(msg.Data)
+				continue
 			}
-			tolog := string(msg.Data)
-			if len(tolog) > 500 {
-				tolog = tolog[:500] + "<...-truncated2-...>"
+			if msg.Type != websocket.TextMessage {
+				logger.Warn("Unexpected message type, ignoring...", "type", msg.Type)
+				continue
 			}
-			log.Printf("Server.Run, a message was received: %s", tolog)
+			logger.Debug("Server.Run, a message was received", "msg", string(msg.Data))
 			srv.dispatch(string(msg.Data))
 		}
 	}
 }
 
+func (srv *Server) handleBinary(data []byte) {
+	sess := srv.Session()
+	if !sess.Authenticated() {
+		logger.Warn("Binary message from an unauthenticated connection, ignoring...")
+		return
+	}
+	h, payload, err := srv.binary.get(data)
+	if err != nil {
+		logger.Warn("Failed to handle a binary message. Ignoring...", "err", err)
+		return
+	}
+	if err := h.(ServerBinaryHandler)(sess, payload); err != nil {
+		logger.Warn("Failed to handle a binary message", "kind", data[0], "err", err)
+	}
+}
+
+func (srv *Server) handleCameraFrame(sess *Session, payload []byte) error {
+	frame, err := decodeCameraFramePayload(payload)
+	if err != nil {
+		return err
+	}
+	srv.frames.Put(frame)
+	if fi, ok := srv.impl.(CameraFrameImpl); ok {
+		if err := fi.CameraFrame(sess, frame); err != nil {
+			return fmt.Errorf("CameraFrame(%q) failed: %v", frame.Camera, err)
+		}
+	}
+	return nil
+}
+
+// SendCameraFrame sends a camera frame to the device as a binary message.
+func (srv *Server) SendCameraFrame(frame *CameraFrame) error {
+	if srv.Agent() != nil && !srv.HasCapability(CapBinaryFrames) {
+		return ErrNotSupported
+	}
+	data, err := EncodeCameraFrame(frame)
+	if err != nil {
+		return fmt.Errorf("failed to encode a camera frame: %v", err)
+	}
+	return srv.conn.SendBinary(data)
+}
+
 func (srv *Server) replyUserError(userMessage string) {
 	err := send(srv.conn, &Response{
 		Status: StatusError,
 		Error:  userMessage,
 	})
 	if err != nil {
-		log.Printf("replyUserError(%q) failed: %v", userMessage, err)
+		logger.Warn("replyUserError failed", "userMessage", userMessage, "err", err)
+	}
+}
+
+// rejectNotify replies with an error to an uplink message. If the message has an ID, it's
+// acknowledged anyway, so that the device does not resend it.
+func (srv *Server) rejectNotify(ack *Ack, userMessage string) {
+	if ack != nil {
+		ack.Status = StatusError
+		ack.Error = userMessage
+	}
+	err := send(srv.conn, &Response{
+		Status: StatusError,
+		Error:  userMessage,
+		Ack:    ack,
+	})
+	if err != nil {
+		logger.Warn("rejectNotify failed", "userMessage", userMessage, "err", err)
 	}
 }
 
 func (srv *Server) replyErr(err error) {
-	log.Printf("replyErr(%v)", err)
+	logger.Error("Backend error", "err", err)
 	srv.replyUserError("backend error")
 }
 
@@ -70,20 +205,108 @@ func (srv *Server) dispatch(msg string) {
 	var req Request
 	err := json.Unmarshal([]byte(msg), &req)
 	if err != nil {
+		logger.Warn("Malformed request", "err", err)
 		srv.replyUserError("malformed request")
 		return
 	}
 	var resp Response
-	switch req.Cmd {
-	case "":
+	if req.Cmd == "" {
 		srv.replyUserError("command not set")
 		return
+	}
+	if userMessage := srv.checkAuth(req.Cmd); userMessage != "" {
+		srv.replyUserError(userMessage)
+		return
+	}
+	sess := srv.Session()
+	switch req.Cmd {
+	case "ack":
+		// Acks are replies themselves, so they don't need a response.
+		srv.handleAck(req.Ack)
+		return
 	case "register-device":
-		err = srv.impl.RegisterDevice(req.Cookie, &resp)
+		err = srv.impl.RegisterDevice(sess, req.Cookie, &resp)
 	case "hello":
-		err = srv.impl.Hello(req.Cookie, req.JobName, &resp)
+		id, authErr := srv.authenticate(req.Cookie)
+		if authErr != nil {
+			logger.Warn("Authentication failed", "err", authErr)
+			srv.replyUserError("authentication failed")
+			return
+		}
+		err = srv.impl.Hello(sess, req.Cookie, req.JobName, &resp)
+		if err == nil && id != nil {
+			if resp.Login == nil {
+				resp.Login = &Login{}
+			}
+			if resp.Login.DeviceName == "" {
+				resp.Login.DeviceName = id.DeviceName
+			}
+		}
+		if err == nil && resp.Login != nil {
+			resp.Login.ProtocolVersion = negotiateProtocolVersion(req.ProtocolVersion)
+			srv.mu.Lock()
+			srv.session = &Session{
+				DeviceName:      resp.Login.DeviceName,
+				JobName:         req.JobName,
+				AuthTime:        time.Now(),
+				Identity:        id,
+				Agent:           req.Agent,
+				ProtocolVersion: resp.Login.ProtocolVersion,
+			}
+			resp.Login.Capabilities = srv.caps
+			srv.mu.Unlock()
+		}
+	case "pair":
+		srv.pair(sess)
+		return
+	case "rotate-token":
+		if err := srv.rotateToken(&resp); err != nil {
+			srv.replyUserError(fmt.Sprintf("failed to rotate the token: %v", err))
+			return
+		}
 	case "notify":
-		err = srv.impl.Notify(req.Msg, &resp)
+		if req.Msg != nil {
+			warnUnknownStates(req.Msg)
+		}
+		if req.Msg != nil && req.Msg.JobEvent != nil {
+			if _, ok := req.Msg.JobEvent.Type.Target(); !ok {
+				srv.replyUserError(fmt.Sprintf("unknown job event type %q", req.Msg.JobEvent.Type))
+				return
+			}
+		}
+		srv.mu.Lock()
+		dedup, jobs := srv.dedup, srv.jobs
+		srv.mu.Unlock()
+		if req.Msg != nil && req.Msg.ID != "" {
+			resp.Ack = &Ack{ID: req.Msg.ID, Status: StatusOK}
+			if dedup != nil && dedup.Seen(sess.DeviceName, req.Msg.ID) {
+				logger.Info("Duplicate uplink message, skipping...", "id", req.Msg.ID, "device", sess.DeviceName)
+				break
+			}
+		}
+		if req.Msg != nil && req.Msg.JobEvent != nil && jobs != nil {
+			if jobErr := jobs.Check(sess.DeviceName, req.Msg.JobEvent); jobErr != nil {
+				logger.Warn("Rejecting a job event", "device", sess.DeviceName, "err", jobErr)
+				srv.rejectNotify(resp.Ack, jobErr.Error())
+				return
+			}
+		}
+		err = srv.impl.Notify(sess, req.Msg, &resp)
+		if err == nil && req.Msg != nil && req.Msg.JobEvent != nil && jobs != nil {
+			if _, jobErr := jobs.Apply(sess.DeviceName, req.Msg.JobEvent); jobErr != nil {
+				logger.Warn("Failed to apply a job event", "device", sess.DeviceName, "err", jobErr)
+			}
+		}
+		if err == nil && resp.Ack != nil && dedup != nil {
+			dedup.Add(sess.DeviceName, req.Msg.ID)
+		}
+	case "terminal":
+		ti, ok := srv.impl.(TerminalImpl)
+		if !ok || req.Terminal == nil {
+			srv.replyUserError("terminal output is not supported")
+			return
+		}
+		err = ti.TerminalOutput(sess, req.Terminal, &resp)
 	default:
 		srv.replyUserError(fmt.Sprintf("unsupported command %q", req.Cmd))
 		return
@@ -95,7 +318,18 @@ func (srv *Server) dispatch(msg string) {
 	resp.Status = StatusOK
 	err = send(srv.conn, &resp)
 	if err != nil {
-		log.Printf("failed to send a response: %v", err)
+		logger.Warn("Failed to send a response", "err", err)
+	}
+}
+
+// warnUnknownStates logs the states which are not known to this version. They are still accepted,
+// as they might come from an older or a newer agent.
+func warnUnknownStates(msg *UplinkMessage) {
+	if !msg.MovingState.Known() {
+		logger.Warn("Unknown moving state in an uplink message, passing as is", "movingState", string(msg.MovingState))
+	}
+	if !msg.GripperState.Known() {
+		logger.Warn("Unknown gripper state in an uplink message, passing as is", "gripperState", string(msg.GripperState))
 	}
 }
 
@@ -0,0 +1,41 @@
+package device_api
+
+import "time"
+
+// Session is the state of a connection, established by a successful hello.
+type Session struct {
+	DeviceName string
+	JobName    string
+	// When hello succeeded. Zero for unauthenticated connections.
+	AuthTime time.Time
+	// The identity verified by the Authenticator. Nil, if the server has no Authenticator.
+	Identity *Identity
+	// The info sent by the agent in hello. Nil, if the agent is too old.
+	Agent           *AgentInfo
+	ProtocolVersion int
+}
+
+// Authenticated reports whether the connection has sent a successful hello.
+// RegisterDevice and Hello are called with an unauthenticated session for new connections.
+func (s *Session) Authenticated() bool {
+	return s != nil && !s.AuthTime.IsZero()
+}
+
+func (s *Session) expired(now time.Time) bool {
+	return s.Identity != nil && s.Identity.expired(now)
+}
+
+// Session returns a copy of the session of the connection. It's unauthenticated before hello.
+func (srv *Server) Session() *Session {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.sessionLocked()
+}
+
+func (srv *Server) sessionLocked() *Session {
+	if srv.session == nil {
+		return &Session{}
+	}
+	sess := *srv.session
+	return &sess
+}
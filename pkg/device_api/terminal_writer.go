@@ -0,0 +1,198 @@
+package device_api
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/terminal"
+)
+
+const (
+	DefaultTerminalFlushInterval = 200 * time.Millisecond
+	DefaultTerminalMaxBatch      = 100
+	DefaultTerminalMaxPending    = 5000
+)
+
+var ErrTerminalWriterClosed = errors.New("terminal writer is closed")
+
+type TerminalWriterOptions struct {
+	// How often the pending lines are sent. DefaultTerminalFlushInterval, if not set.
+	FlushInterval time.Duration
+	// The maximum number of lines in a batch. DefaultTerminalMaxBatch, if not set.
+	MaxBatch int
+	// The maximum number of lines waiting to be sent. If more lines are written,
+	// the oldest ones are dropped. DefaultTerminalMaxPending, if not set.
+	MaxPending int
+}
+
+// TerminalWriter is an io.Writer which streams terminal output to the server line by line.
+// Writes never block on the network: lines are accumulated and sent in batches by a separate
+// goroutine, and if the network can't keep up, the oldest pending lines are dropped
+// (and reported in TerminalBatch.Dropped).
+type TerminalWriter struct {
+	c    *Client
+	opts TerminalWriterOptions
+
+	mu          sync.Mutex
+	partial     []byte
+	pending     []terminal.Line
+	lastSeq     int64
+	inflightSeq int64
+	dropped     int64
+	// Lines of the batch in flight, which were evicted from pending. They are dropped
+	// if the batch fails.
+	inflightDropped int64
+	closed          bool
+
+	kick    chan bool
+	stopped chan bool
+	done    chan bool
+}
+
+func NewTerminalWriter(c *Client, opts TerminalWriterOptions) *TerminalWriter {
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultTerminalFlushInterval
+	}
+	if opts.MaxBatch <= 0 {
+		opts.MaxBatch = DefaultTerminalMaxBatch
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = DefaultTerminalMaxPending
+	}
+	tw := &TerminalWriter{
+		c:       c,
+		opts:    opts,
+		kick:    make(chan bool, 1),
+		stopped: make(chan bool),
+		done:    make(chan bool),
+	}
+	go tw.run()
+	return tw
+}
+
+func (tw *TerminalWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.closed {
+		return 0, ErrTerminalWriterClosed
+	}
+	tw.partial = append(tw.partial, p...)
+	for {
+		idx := bytes.IndexByte(tw.partial, '\n')
+		if idx < 0 {
+			break
+		}
+		tw.appendLocked(string(bytes.TrimSuffix(tw.partial[:idx], []byte("\r"))))
+		tw.partial = tw.partial[idx+1:]
+	}
+	if len(tw.pending) >= tw.opts.MaxBatch {
+		select {
+		case tw.kick <- true:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (tw *TerminalWriter) appendLocked(text string) {
+	tw.lastSeq++
+	tw.pending = append(tw.pending, terminal.Line{
+		Seq:  tw.lastSeq,
+		TS:   time.Now().UnixNano() / int64(time.Millisecond),
+		Text: text,
+	})
+	if excess := len(tw.pending) - tw.opts.MaxPending; excess > 0 {
+		for _, line := range tw.pending[:excess] {
+			if line.Seq > tw.inflightSeq {
+				tw.dropped++
+			} else {
+				tw.inflightDropped++
+			}
+		}
+		tw.pending = append([]terminal.Line(nil), tw.pending[excess:]...)
+	}
+}
+
+func (tw *TerminalWriter) run() {
+	defer close(tw.done)
+	ticker := time.NewTicker(tw.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tw.stopped:
+			tw.flush()
+			return
+		case <-tw.c.Stopped():
+			return
+		case <-ticker.C:
+			tw.flush()
+		case <-tw.kick:
+			tw.flush()
+		}
+	}
+}
+
+// flush sends the pending lines in batches. If sending fails, the lines stay pending
+// and are retried on the next flush.
+func (tw *TerminalWriter) flush() {
+	for {
+		tw.mu.Lock()
+		n := len(tw.pending)
+		if n == 0 {
+			tw.mu.Unlock()
+			return
+		}
+		if n > tw.opts.MaxBatch {
+			n = tw.opts.MaxBatch
+		}
+		batch := &TerminalBatch{
+			Lines:   append([]terminal.Line(nil), tw.pending[:n]...),
+			Dropped: tw.dropped,
+		}
+		tw.inflightSeq = batch.Lines[n-1].Seq
+		tw.mu.Unlock()
+
+		err := tw.c.SendTerminalOutput(batch)
+
+		tw.mu.Lock()
+		tw.inflightSeq = 0
+		inflightDropped := tw.inflightDropped
+		tw.inflightDropped = 0
+		if err != nil {
+			// The lines evicted while the batch was in flight are lost now.
+			tw.dropped += inflightDropped
+			tw.mu.Unlock()
+			logger.Warn("Failed to send terminal output. Will retry later", "err", err)
+			return
+		}
+		tw.dropped -= batch.Dropped
+		sent := batch.Lines[len(batch.Lines)-1].Seq
+		i := 0
+		for i < len(tw.pending) && tw.pending[i].Seq <= sent {
+			i++
+		}
+		tw.pending = tw.pending[i:]
+		tw.mu.Unlock()
+	}
+}
+
+// Close sends the incomplete last line (if any) and the pending lines, and stops the writer.
+// Writes after Close fail with ErrTerminalWriterClosed.
+func (tw *TerminalWriter) Close() error {
+	tw.mu.Lock()
+	if tw.closed {
+		tw.mu.Unlock()
+		return nil
+	}
+	tw.closed = true
+	if len(tw.partial) > 0 {
+		tw.appendLocked(string(tw.partial))
+		tw.partial = nil
+	}
+	tw.mu.Unlock()
+	close(tw.stopped)
+	<-tw.done
+	return nil
+}
@@ -0,0 +1,328 @@
+package device_api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const DefaultChunkSize = 64 * 1024
+
+// The kind of binary messages with file chunks, see encodeFileChunk.
+const binaryKindFileChunk = 2
+
+// FileReceiver stores files sent by the server. Implementations must be safe for concurrent use.
+type FileReceiver interface {
+	// Begin starts or resumes a transfer. It returns the number of bytes already received.
+	Begin(t *FileTransfer) (offset int64, err error)
+	// WriteChunk saves the chunk. Chunks come in order, starting from the offset returned by Begin.
+	WriteChunk(chunk *FileChunk) error
+	// End verifies the complete file.
+	End(t *FileTransfer) error
+}
+
+// HandleTransfers registers the handlers for file transfer commands, which save files using r.
+func (c *Client) HandleTransfers(r FileReceiver) {
+	c.handleCommandAck(CmdTransferBegin, func(cmd *Command, ack *Ack) error {
+		if cmd.Transfer == nil {
+			return errors.New("transfer is not set")
+		}
+		offset, err := r.Begin(cmd.Transfer)
+		ack.Offset = offset
+		return err
+	})
+	c.handleCommandAck(CmdTransferChunk, func(cmd *Command, ack *Ack) error {
+		chunk := cmd.Chunk
+		if chunk == nil {
+			return errors.New("chunk is not set")
+		}
+		if got := sha256Hex(chunk.Data); got != chunk.SHA256 {
+			return fmt.Errorf("chunk checksum mismatch at offset %d: got %s, want %s", chunk.Offset, got, chunk.SHA256)
+		}
+		if err := r.WriteChunk(chunk); err != nil {
+			return err
+		}
+		ack.Offset = chunk.Offset + int64(len(chunk.Data))
+		return nil
+	})
+	c.handleCommandAck(CmdTransferEnd, func(cmd *Command, ack *Ack) error {
+		if cmd.Transfer == nil {
+			return errors.New("transfer is not set")
+		}
+		return r.End(cmd.Transfer)
+	})
+}
+
+// encodeFileChunk serializes a transfer-chunk command into a binary message:
+//
+//	kind (1 byte) | len(id) (1 byte) | id | len(transferID) (1 byte) | transferID |
+//	offset (8 bytes, big endian) | sha256 (32 bytes) | data
+func encodeFileChunk(cmdID string, chunk *FileChunk) ([]byte, error) {
+	if len(cmdID) > math.MaxUint8 || len(chunk.TransferID) > math.MaxUint8 {
+		return nil, errors.New("command or transfer id is too long")
+	}
+	sum, err := hex.DecodeString(chunk.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid chunk checksum %q", chunk.SHA256)
+	}
+	res := make([]byte, 0, 1+1+len(cmdID)+1+len(chunk.TransferID)+8+sha256.Size+len(chunk.Data))
+	res = append(res, binaryKindFileChunk, byte(len(cmdID)))
+	res = append(res, cmdID...)
+	res = append(res, byte(len(chunk.TransferID)))
+	res = append(res, chunk.TransferID...)
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(chunk.Offset))
+	res = append(res, offset[:]...)
+	res = append(res, sum...)
+	res = append(res, chunk.Data...)
+	return res, nil
+}
+
+// decodeFileChunkPayload parses a message created by encodeFileChunk without the kind byte.
+// The data of the chunk is copied.
+func decodeFileChunkPayload(rest []byte) (*Command, error) {
+	id, rest, err := readShortString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read command id: %v", err)
+	}
+	transferID, rest, err := readShortString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transfer id: %v", err)
+	}
+	if len(rest) < 8+sha256.Size {
+		return nil, errors.New("failed to read offset and checksum: message is too short")
+	}
+	return &Command{
+		ID:   id,
+		Name: CmdTransferChunk,
+		Chunk: &FileChunk{
+			TransferID: transferID,
+			Offset:     int64(binary.BigEndian.Uint64(rest[:8])),
+			SHA256:     hex.EncodeToString(rest[8 : 8+sha256.Size]),
+			Data:       append([]byte(nil), rest[8+sha256.Size:]...),
+		},
+	}, nil
+}
+
+// handleFileChunk queues a binary file chunk as a transfer-chunk command, so that it's handled
+// in order with the other commands.
+func (c *Client) handleFileChunk(payload []byte) error {
+	cmd, err := decodeFileChunkPayload(payload)
+	if err != nil {
+		return err
+	}
+	c.queueCommand(cmd)
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func transferID(name, sha string) string {
+	return sha256Hex([]byte(name + "\x00" + sha))[:32]
+}
+
+// TransferProgress is called after every chunk acknowledged by the device.
+type TransferProgress func(sent, total int64)
+
+// SendFile sends the contents of r to the device in chunks, verifying the checksum of every chunk
+// and of the whole file. If the device already has a part of the file (for example, the previous
+// attempt was interrupted by a reconnect), the transfer is resumed from where it stopped.
+// If the device supports CapBinaryChunks, the chunks are sent as binary messages.
+// progress may be nil.
+func (srv *Server) SendFile(ctx context.Context, name string, r io.ReaderAt, size int64, progress TransferProgress) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return fmt.Errorf("failed to read %s: %v", name, err)
+	}
+	t := &FileTransfer{
+		Name:   name,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}
+	t.ID = transferID(name, t.SHA256)
+
+	ack, err := srv.SendCommand(ctx, &Command{Name: CmdTransferBegin, Transfer: t})
+	if err != nil {
+		return err
+	}
+	offset := ack.Offset
+	if offset < 0 || offset > size {
+		return fmt.Errorf("device reported invalid offset %d for %s (size: %d)", offset, name, size)
+	}
+	binaryChunks := srv.HasCapability(CapBinaryChunks)
+	buf := make([]byte, DefaultChunkSize)
+	for offset < size {
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read %s at %d: %v", name, offset, err)
+		}
+		if n == 0 {
+			return fmt.Errorf("failed to read %s at %d: unexpected end of file (size: %d)", name, offset, size)
+		}
+		data := buf[:n]
+		chunk := &FileChunk{
+			TransferID: t.ID,
+			Offset:     offset,
+			Data:       data,
+			SHA256:     sha256Hex(data),
+		}
+		cmd := &Command{Name: CmdTransferChunk}
+		var encode func() ([]byte, error)
+		if binaryChunks {
+			encode = func() ([]byte, error) { return encodeFileChunk(cmd.ID, chunk) }
+		} else {
+			cmd.Chunk = chunk
+		}
+		ack, err := srv.sendCommand(ctx, cmd, encode)
+		if err != nil {
+			return err
+		}
+		if ack.Offset != offset+int64(n) {
+			return fmt.Errorf("device reported unexpected offset %d, want: %d", ack.Offset, offset+int64(n))
+		}
+		offset = ack.Offset
+		if progress != nil {
+			progress(offset, size)
+		}
+	}
+	_, err = srv.SendCommand(ctx, &Command{Name: CmdTransferEnd, Transfer: t})
+	return err
+}
+
+// DiskReceiver is a FileReceiver which saves files into a local directory. Partially received
+// files are kept as <ID>.part next to <ID>.json with the transfer description, so that the transfer
+// can be resumed after a reconnect or a restart. Complete files are saved as Dir/<Name>.
+type DiskReceiver struct {
+	Dir string
+	// Completed, if set, is called for every complete file.
+	Completed func(t *FileTransfer, path string)
+
+	mu sync.Mutex
+}
+
+func NewDiskReceiver(dir string) (*DiskReceiver, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	return &DiskReceiver{Dir: dir}, nil
+}
+
+func (dr *DiskReceiver) partPath(id string) string {
+	return filepath.Join(dr.Dir, filepath.Base(id)+".part")
+}
+
+func (dr *DiskReceiver) metaPath(id string) string {
+	return filepath.Join(dr.Dir, filepath.Base(id)+".json")
+}
+
+// filePath returns the path of the complete file. Only the base name of the file is used,
+// and it must not refer to Dir itself or its parent.
+func (dr *DiskReceiver) filePath(t *FileTransfer) (string, error) {
+	name := filepath.Base(t.Name)
+	if t.Name == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("invalid file name %q", t.Name)
+	}
+	return filepath.Join(dr.Dir, name), nil
+}
+
+func (dr *DiskReceiver) Begin(t *FileTransfer) (int64, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	if t.ID == "" || t.ID != filepath.Base(t.ID) {
+		return 0, fmt.Errorf("invalid transfer id %q", t.ID)
+	}
+	if _, err := dr.filePath(t); err != nil {
+		return 0, err
+	}
+	if data, err := ioutil.ReadFile(dr.metaPath(t.ID)); err == nil {
+		var prev FileTransfer
+		if err := json.Unmarshal(data, &prev); err == nil && prev == *t {
+			if st, err := os.Stat(dr.partPath(t.ID)); err == nil && st.Size() <= t.Size {
+				return st.Size(), nil
+			}
+		}
+	}
+	// Start from scratch.
+	data, err := json.Marshal(t)
+	if err != nil {
+		return 0, err
+	}
+	if err := ioutil.WriteFile(dr.metaPath(t.ID), data, 0644); err != nil {
+		return 0, fmt.Errorf("failed to save transfer metadata: %v", err)
+	}
+	if err := ioutil.WriteFile(dr.partPath(t.ID), nil, 0644); err != nil {
+		return 0, fmt.Errorf("failed to create %s: %v", dr.partPath(t.ID), err)
+	}
+	return 0, nil
+}
+
+func (dr *DiskReceiver) WriteChunk(chunk *FileChunk) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	f, err := os.OpenFile(dr.partPath(chunk.TransferID), os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unknown transfer %q: %v", chunk.TransferID, err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.Size() != chunk.Offset {
+		return fmt.Errorf("unexpected chunk offset %d, want: %d", chunk.Offset, st.Size())
+	}
+	if _, err := f.WriteAt(chunk.Data, chunk.Offset); err != nil {
+		return fmt.Errorf("failed to write a chunk: %v", err)
+	}
+	return f.Sync()
+}
+
+func (dr *DiskReceiver) End(t *FileTransfer) error {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	path, err := dr.filePath(t)
+	if err != nil {
+		return err
+	}
+	part := dr.partPath(t.ID)
+	f, err := os.Open(part)
+	if err != nil {
+		return fmt.Errorf("unknown transfer %q: %v", t.ID, err)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", part, err)
+	}
+	if n != t.Size {
+		return fmt.Errorf("incomplete file: %d bytes received, want: %d", n, t.Size)
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != t.SHA256 {
+		// The partial file is corrupted, so the next attempt must start from scratch.
+		os.Remove(part)
+		os.Remove(dr.metaPath(t.ID))
+		return fmt.Errorf("file checksum mismatch: got %s, want %s", got, t.SHA256)
+	}
+	if err := os.Rename(part, path); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %v", part, path, err)
+	}
+	os.Remove(dr.metaPath(t.ID))
+	if dr.Completed != nil {
+		dr.Completed(t, path)
+	}
+	return nil
+}
@@ -1,6 +1,14 @@
 package device_api
 
-import "time"
+import (
+	"encoding/json"
+	"runtime"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/job"
+	"github.com/robodone/robosla-common/pkg/opapi"
+	"github.com/robodone/robosla-common/pkg/terminal"
+)
 
 const (
 	StatusOK    = "OK"
@@ -8,11 +16,39 @@ const (
 	backlogSize = 30
 )
 
+// ProtocolVersion is the latest version of the device API protocol supported by this library.
+// Version 1 is the legacy one, used by the agents and servers which don't send the version:
+// in it, UplinkMessage.Elapsed and UplinkMessage.Remaining were encoded under their Go names.
+const ProtocolVersion = 2
+
+// Optional features, which are only used when both sides support them.
+const (
+	CapBinaryFrames   = "binary-frames"
+	CapCommands       = "commands"
+	CapFileTransfer   = "file-transfer"
+	CapTerminalStream = "terminal-stream"
+	// The server acknowledges uplink messages with IDs, and drops duplicates.
+	CapUplinkAcks = "uplink-acks"
+	// File chunks are sent as binary messages instead of base64 in JSON commands.
+	CapBinaryChunks = "binary-chunks"
+)
+
+// DefaultCapabilities are the features implemented by this library.
+var DefaultCapabilities = []string{CapBinaryFrames, CapCommands, CapFileTransfer, CapTerminalStream, CapUplinkAcks, CapBinaryChunks}
+
 type Request struct {
 	Cmd     string         `json:"cmd"`
 	Cookie  string         `json:"cookie,omitempty"`
 	JobName string         `json:"jobName,omitempty"`
 	Msg     *UplinkMessage `json:"msg,omitempty"`
+	// The latest protocol version supported by the device, sent with hello.
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+	// Information about the agent, sent with hello.
+	Agent *AgentInfo `json:"agent,omitempty"`
+	// Terminal output, sent with the "terminal" command.
+	Terminal *TerminalBatch `json:"terminal,omitempty"`
+	// Acknowledgement of a downlink command, sent with the "ack" command.
+	Ack *Ack `json:"ack,omitempty"`
 }
 
 type Response struct {
@@ -20,11 +56,50 @@ type Response struct {
 	Error  string      `json:"error,omitempty"`
 	Login  *Login      `json:"login,omitempty"`
 	TS     *TimeSeries `json:"ts,omitempty"`
+	// A downlink command for the device. It's not a part of the state, and the device
+	// must reply with an Ack.
+	Command *Command `json:"command,omitempty"`
+	// The pairing code to display on the device, sent in response to the "pair" command.
+	Pairing *Pairing `json:"pairing,omitempty"`
+	// Acknowledgement of an uplink message with an ID, sent in response to notify.
+	Ack *Ack `json:"ack,omitempty"`
 }
 
 type Login struct {
 	Cookie     string `json:"cookie"`
 	DeviceName string `json:"deviceName,omitempty"`
+	// The protocol version to use for the session: the latest one supported by both sides.
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+	// The features supported by the server.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// AgentInfo describes the agent running on the device.
+type AgentInfo struct {
+	Version string `json:"version"`
+	OS      string `json:"os,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	// The features supported by the agent.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// NewAgentInfo returns the info about the current agent binary with DefaultCapabilities.
+func NewAgentInfo(version string) *AgentInfo {
+	return &AgentInfo{
+		Version:      version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Capabilities: DefaultCapabilities,
+	}
+}
+
+func hasCapability(caps []string, capability string) bool {
+	for _, c := range caps {
+		if c == capability {
+			return true
+		}
+	}
+	return false
 }
 
 type TimeSeries struct {
@@ -36,21 +111,165 @@ type StringSample struct {
 	Value string `json:"value"`
 }
 
+// TerminalBatch is a portion of the terminal output of a device.
+type TerminalBatch struct {
+	Lines []terminal.Line `json:"lines"`
+	// The number of lines dropped by the device before this batch, because they could not be sent in time.
+	Dropped int64 `json:"dropped,omitempty"`
+}
+
+// Names of the downlink commands.
+const (
+	CmdStartJob           = "start-job"
+	CmdPause              = "pause"
+	CmdResume             = "resume"
+	CmdCancel             = "cancel"
+	CmdHome               = "home"
+	CmdSetGripper         = "set-gripper"
+	CmdRequestCameraFrame = "request-camera-frame"
+	CmdTransferBegin      = "transfer-begin"
+	CmdTransferChunk      = "transfer-chunk"
+	CmdTransferEnd        = "transfer-end"
+)
+
+// Command is sent from the server to the device.
+type Command struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// For start-job.
+	JobName string `json:"jobName,omitempty"`
+	// For home. Empty means all axes.
+	Axes []string `json:"axes,omitempty"`
+	// For set-gripper.
+	GripperState opapi.GripperState `json:"gripperState,omitempty"`
+	// For request-camera-frame.
+	Camera string `json:"camera,omitempty"`
+	// For transfer-begin and transfer-end.
+	Transfer *FileTransfer `json:"transfer,omitempty"`
+	// For transfer-chunk.
+	Chunk *FileChunk `json:"chunk,omitempty"`
+}
+
+// Ack is the reply of the device to a Command with the same ID.
+type Ack struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// For transfer-begin and transfer-chunk: the number of bytes the device has received so far.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// FileTransfer describes a file sent from the server to the device.
+type FileTransfer struct {
+	// ID is derived from the name and the contents of the file, so that the transfer
+	// of the same file can be resumed after a reconnect.
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type FileChunk struct {
+	TransferID string `json:"transferID"`
+	Offset     int64  `json:"offset"`
+	Data       []byte `json:"data"`
+	SHA256     string `json:"sha256"`
+}
+
+// UplinkMessage is a status update from the device. Durations are encoded in nanoseconds,
+// as in opapi.PrinterForProgress.
+//
+// Decoding accepts both the legacy (version 1) and the current field names: JSON keys are matched
+// to the struct fields case-insensitively, so "Elapsed" and "Remaining" end up in the right fields.
 type UplinkMessage struct {
-	Type           string        `json:"type"`
-	JobName        string        `json:"jobName"`
-	Success        bool          `json:"success"`
-	Comment        string        `json:"comment"`
-	Elapsed        time.Duration `json:elapsed"`
-	Remaining      time.Duration `json:duration"`
-	Progress       float64       `json:"progress"`
-	FrameIndex     int           `json:"frameIndex"`
-	NumFrames      int           `json:"numFrames"`
-	MovingState    string        `json:"movingState"`
-	Pose           []float64     `json:"pose"`
-	GripperState   string        `json:"gripperState"`
-	TerminalOutput string        `json:"terminalOutput,omitempty"`
+	// The version of the schema the message was encoded with. It's set by MarshalJSON;
+	// legacy messages don't have it.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+
+	// A unique ID, so that the server can drop the duplicates of a message resent after a reconnect.
+	// Client.Notify sets it.
+	ID string `json:"id,omitempty"`
+	// When the message was created, in Unix milliseconds. Messages from the offline queue keep
+	// the original time. Client.Notify sets it.
+	CreatedAt int64 `json:"createdAt,omitempty"`
+
+	Type           string             `json:"type"`
+	JobName        string             `json:"jobName"`
+	Success        bool               `json:"success"`
+	Comment        string             `json:"comment"`
+	Elapsed        time.Duration      `json:"elapsed"`
+	Remaining      time.Duration      `json:"remaining"`
+	Progress       float64            `json:"progress"`
+	FrameIndex     int                `json:"frameIndex"`
+	NumFrames      int                `json:"numFrames"`
+	MovingState    opapi.MovingState  `json:"movingState"`
+	Pose           []float64          `json:"pose"`
+	GripperState   opapi.GripperState `json:"gripperState"`
+	TerminalOutput string             `json:"terminalOutput,omitempty"`
+
+	// A change in the lifecycle of the job. Type is set to the type of the event.
+	JobEvent *job.Event `json:"jobEvent,omitempty"`
 
 	// Data URL-encoded camera frames saved by their respective names.
+	//
+	// Deprecated: use Client.SendCameraFrame, which sends frames as binary messages.
 	Cameras map[string]string `json:"cameras"`
+
+	// The version to encode the message with. ProtocolVersion, if not set.
+	wireVersion int
+}
+
+type uplinkMessageWire UplinkMessage
+
+var legacyUplinkFields = map[string]string{
+	"elapsed":   "Elapsed",
+	"remaining": "Remaining",
+}
+
+func (msg UplinkMessage) MarshalJSON() ([]byte, error) {
+	version := msg.wireVersion
+	if version == 0 {
+		version = ProtocolVersion
+	}
+	w := uplinkMessageWire(msg)
+	if version >= 2 {
+		w.SchemaVersion = version
+		return json.Marshal(&w)
+	}
+	w.SchemaVersion = 0
+	data, err := json.Marshal(&w)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	delete(m, "schemaVersion")
+	for name, legacyName := range legacyUplinkFields {
+		if val, ok := m[name]; ok {
+			delete(m, name)
+			m[legacyName] = val
+		}
+	}
+	return json.Marshal(m)
+}
+
+// withWireVersion returns a copy of the message, which will be encoded with the specified protocol version.
+func (msg *UplinkMessage) withWireVersion(version int) *UplinkMessage {
+	res := *msg
+	res.wireVersion = version
+	return &res
+}
+
+// negotiateProtocolVersion returns the latest version supported by both sides.
+func negotiateProtocolVersion(peerVersion int) int {
+	if peerVersion <= 0 {
+		// The peer doesn't know about versions.
+		return 1
+	}
+	if peerVersion < ProtocolVersion {
+		return peerVersion
+	}
+	return ProtocolVersion
 }
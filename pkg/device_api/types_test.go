@@ -0,0 +1,132 @@
+package device_api
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/opapi"
+)
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+func testUplinkMessage() *UplinkMessage {
+	return &UplinkMessage{
+		Type:         "progress",
+		JobName:      "job1",
+		Success:      true,
+		Comment:      "printing",
+		Elapsed:      90 * time.Second,
+		Remaining:    30 * time.Minute,
+		Progress:     0.25,
+		FrameIndex:   10,
+		NumFrames:    40,
+		MovingState:  opapi.MovingStateMoving,
+		Pose:         []float64{1, 2.5, 3},
+		GripperState: opapi.GripperStateClosed,
+		Cameras:      map[string]string{"top": "data:image/jpeg;base64,AAAA"},
+	}
+}
+
+func checkGolden(t *testing.T, name string, got []byte) {
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, append(got, '\n'), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if !bytes.Equal(got, bytes.TrimSpace(want)) {
+		t.Errorf("%s: JSON format changed.\ngot:\n%s\nwant:\n%s\nRun with -update, if it's intended.", name, got, want)
+	}
+}
+
+func TestUplinkMessageGolden(t *testing.T) {
+	data, err := json.Marshal(testUplinkMessage().withWireVersion(2))
+	if err != nil {
+		t.Fatalf("Marshal(v2): %v", err)
+	}
+	checkGolden(t, "uplink_v2.json", data)
+
+	var got UplinkMessage
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Unmarshal(v2): %v", err)
+	}
+	want := testUplinkMessage()
+	want.SchemaVersion = 2
+	if !reflect.DeepEqual(&got, want) {
+		t.Errorf("Unmarshal(v2): %+v, want: %+v", got, want)
+	}
+}
+
+// legacyUplinkMessage is UplinkMessage as it was before the protocol versions. Its tags for
+// Elapsed and Remaining were malformed, so they were encoded under their Go names.
+type legacyUplinkMessage struct {
+	Type           string `json:"type"`
+	JobName        string `json:"jobName"`
+	Success        bool   `json:"success"`
+	Comment        string `json:"comment"`
+	Elapsed        time.Duration
+	Remaining      time.Duration
+	Progress       float64           `json:"progress"`
+	FrameIndex     int               `json:"frameIndex"`
+	NumFrames      int               `json:"numFrames"`
+	MovingState    string            `json:"movingState"`
+	Pose           []float64         `json:"pose"`
+	GripperState   string            `json:"gripperState"`
+	TerminalOutput string            `json:"terminalOutput,omitempty"`
+	Cameras        map[string]string `json:"cameras"`
+}
+
+// TestUplinkMessageV1 checks the compatibility with legacy agents and servers. testdata/uplink_v1.json
+// is a message sent by a legacy agent; it must not be regenerated.
+func TestUplinkMessageV1(t *testing.T) {
+	legacy, err := ioutil.ReadFile(filepath.Join("testdata", "uplink_v1.json"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	var got UplinkMessage
+	if err := json.Unmarshal(legacy, &got); err != nil {
+		t.Fatalf("Unmarshal(v1): %v", err)
+	}
+	if want := testUplinkMessage(); !reflect.DeepEqual(&got, want) {
+		t.Errorf("Unmarshal(v1): %+v, want: %+v", got, want)
+	}
+
+	// A legacy server must decode v1 messages into the same struct as the ones from legacy agents.
+	data, err := json.Marshal(testUplinkMessage().withWireVersion(1))
+	if err != nil {
+		t.Fatalf("Marshal(v1): %v", err)
+	}
+	var gotLegacy, wantLegacy legacyUplinkMessage
+	if err := json.Unmarshal(data, &gotLegacy); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", data, err)
+	}
+	if err := json.Unmarshal(legacy, &wantLegacy); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", legacy, err)
+	}
+	if !reflect.DeepEqual(gotLegacy, wantLegacy) {
+		t.Errorf("v1 message decoded by a legacy server: %+v, want: %+v", gotLegacy, wantLegacy)
+	}
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	for _, tt := range []struct{ peer, want int }{
+		{0, 1},
+		{1, 1},
+		{ProtocolVersion, ProtocolVersion},
+		{ProtocolVersion + 1, ProtocolVersion},
+	} {
+		if got := negotiateProtocolVersion(tt.peer); got != tt.want {
+			t.Errorf("negotiateProtocolVersion(%d): %d, want: %d", tt.peer, got, tt.want)
+		}
+	}
+}
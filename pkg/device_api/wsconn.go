@@ -1,71 +1,263 @@
 package device_api
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/robodone/robosla-common/pkg/syncws"
 )
 
+const DefaultHandshakeTimeout = 45 * time.Second
+
+// How long Close waits for the queued messages to be sent.
+const closeDrainTimeout = 5 * time.Second
+
+// WSConn is a Conn over a websocket. Outgoing messages are queued by priority and written
+// by a separate goroutine, so sending never blocks on the network. Writes are limited by
+// the WriteTimeout of the socket.
 type WSConn struct {
 	sock *syncws.Socket
 	inCh chan *Message
+	out  *outQueues
+	// Closed, when writeLoop exits.
+	writerDone chan bool
+	// The reason In() was closed, for example, syncws.ErrConnectionDead.
+	errMu sync.Mutex
+	err   error
 }
 
-func ConnectWS(apiServer string) (Conn, error) {
-	url := fmt.Sprintf("wss://%s/device-api/v1", apiServer)
-	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+// DialConfig describes how to connect to the device API. Only Server or URL must be set.
+type DialConfig struct {
+	// The API server, like ProdAPIServer. The endpoint is wss://<Server>/device-api/v1.
+	Server string
+	// The full endpoint URL, like ws://localhost:8080/device-api/v1. Overrides Server.
+	URL string
+	// The CAs to verify the server certificate with. The system pool, if nil.
+	RootCAs *x509.CertPool
+	// The client certificates for mutual TLS.
+	Certificates []tls.Certificate
+	// Proxy returns the proxy for the request. http.ProxyFromEnvironment, if nil.
+	Proxy func(*http.Request) (*url.URL, error)
+	// DefaultHandshakeTimeout, if zero.
+	HandshakeTimeout time.Duration
+	// Extra headers sent with the handshake request.
+	Header http.Header
+	// The keepalive, the read limit and the compression. syncws.DefaultOptions, if nil.
+	Socket *syncws.Options
+	// DefaultQueueOptions, if nil.
+	Queue *QueueOptions
+}
+
+func (cfg *DialConfig) endpoint() (string, error) {
+	if cfg.URL != "" {
+		return cfg.URL, nil
+	}
+	if cfg.Server == "" {
+		return "", fmt.Errorf("neither URL nor Server is set")
+	}
+	return fmt.Sprintf("wss://%s/device-api/v1", cfg.Server), nil
+}
+
+func (cfg *DialConfig) dialer() *websocket.Dialer {
+	d := &websocket.Dialer{
+		Proxy:            cfg.Proxy,
+		HandshakeTimeout: cfg.HandshakeTimeout,
+	}
+	if d.Proxy == nil {
+		d.Proxy = http.ProxyFromEnvironment
+	}
+	if d.HandshakeTimeout == 0 {
+		d.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if cfg.RootCAs != nil || len(cfg.Certificates) > 0 {
+		d.TLSClientConfig = &tls.Config{
+			RootCAs:      cfg.RootCAs,
+			Certificates: cfg.Certificates,
+		}
+	}
+	return d
+}
+
+// Dial connects to the device API as described by cfg.
+func Dial(cfg *DialConfig) (Conn, error) {
+	endpoint, err := cfg.endpoint()
+	if err != nil {
+		return nil, err
+	}
+	opts := syncws.DefaultOptions
+	if cfg.Socket != nil {
+		opts = *cfg.Socket
+	}
+	sock, resp, err := syncws.Dial(cfg.dialer(), endpoint, cfg.Header, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to dial %q: %v", url, err)
+		if resp != nil {
+			return nil, fmt.Errorf("failed to dial %q: %v (HTTP status: %s)", endpoint, err, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to dial %q: %v", endpoint, err)
+	}
+	queueOpts := DefaultQueueOptions
+	if cfg.Queue != nil {
+		queueOpts = *cfg.Queue
+	}
+	return NewWSConnWithOptions(sock, queueOpts), nil
+}
+
+// UpgradeWS accepts a connection from a device on the server side.
+// syncws.DefaultOptions are used, if opts is nil.
+func UpgradeWS(w http.ResponseWriter, r *http.Request, opts *syncws.Options) (*WSConn, error) {
+	sockOpts := syncws.DefaultOptions
+	if opts != nil {
+		sockOpts = *opts
+	}
+	sock, err := syncws.Upgrade(nil, w, r, sockOpts)
+	if err != nil {
+		return nil, err
 	}
-	sock := syncws.NewSocket(conn)
 	return NewWSConn(sock), nil
 }
 
+func ConnectWS(apiServer string) (Conn, error) {
+	return Dial(&DialConfig{Server: apiServer})
+}
+
+// LoadCertPool reads PEM encoded CA certificates, for example, of an on-prem server.
+func LoadCertPool(pemFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(pemFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", pemFile)
+	}
+	return pool, nil
+}
+
 func NewWSConn(sock *syncws.Socket) *WSConn {
+	return NewWSConnWithOptions(sock, DefaultQueueOptions)
+}
+
+func NewWSConnWithOptions(sock *syncws.Socket, opts QueueOptions) *WSConn {
 	wsc := &WSConn{
-		sock: sock,
-		inCh: make(chan *Message, backlogSize),
+		sock:       sock,
+		inCh:       make(chan *Message, backlogSize),
+		out:        newOutQueues(opts),
+		writerDone: make(chan bool),
 	}
 	go wsc.run()
+	go wsc.writeLoop()
 	return wsc
 }
 
+func (wsc *WSConn) writeLoop() {
+	defer close(wsc.writerDone)
+	for {
+		msg := wsc.out.wait()
+		if msg == nil {
+			return
+		}
+		var err error
+		if msg.typ == websocket.BinaryMessage {
+			err = wsc.sock.WriteBinaryMessage(msg.data)
+		} else {
+			err = wsc.sock.WriteMessage(msg.data)
+		}
+		if err != nil {
+			// The socket has already logged the error. Closing it also stops the reader,
+			// so the owner of the connection will notice.
+			wsc.out.close()
+			wsc.sock.Close()
+			return
+		}
+	}
+}
+
 func (wsc *WSConn) run() {
 	for {
 		messageType, p, err := wsc.sock.ReadMessage()
 		if err != nil {
-			log.Printf("ReadMessage failed: %v. Stop listening for incoming messages.", err)
+			logger.Info("ReadMessage failed. Stop listening for incoming messages", "err", err)
+			wsc.errMu.Lock()
+			wsc.err = err
+			wsc.errMu.Unlock()
 			close(wsc.inCh)
 			return
 		}
-		toprint := string(p)
-		if len(toprint) > 500 {
-			toprint = toprint[:500]
+		if messageType == websocket.TextMessage {
+			logger.Debug("A message received", "msg", string(p))
+		} else {
+			logger.Debug("A binary message received", "size", len(p))
 		}
-		log.Printf("A message received: %s", toprint)
 		select {
 		case wsc.inCh <- &Message{Type: messageType, Data: p}:
 		default:
-			log.Printf("Incoming message dropped due to reaching the limit for backlog (%d messages)", backlogSize)
+			logger.Warn("Incoming message dropped due to reaching the limit for backlog", "backlog", backlogSize)
 		}
 	}
 }
 
+// Err returns the error which closed In(), or nil while the connection is alive.
+func (wsc *WSConn) Err() error {
+	wsc.errMu.Lock()
+	defer wsc.errMu.Unlock()
+	return wsc.err
+}
+
+// Stats returns the traffic counters of the socket, including the bytes saved by compression.
+func (wsc *WSConn) Stats() syncws.Stats {
+	return wsc.sock.Stats()
+}
+
+// RTT returns the round-trip time to the other side, measured with keepalive pings.
+// It's zero until the first pong.
+func (wsc *WSConn) RTT() time.Duration {
+	return wsc.sock.RTT()
+}
+
+// Close sends the queued messages, waiting up to closeDrainTimeout, and closes the socket.
+// The messages sent after Close fail with ErrConnClosed.
 func (wsc *WSConn) Close() error {
+	wsc.out.close()
+	select {
+	case <-wsc.writerDone:
+	case <-time.After(closeDrainTimeout):
+		logger.Warn("Timed out sending the queued messages. Closing the connection anyway")
+	}
 	return wsc.sock.Close()
 }
 
+// Dropped returns the number of messages of the class dropped due to the queue limits.
+func (wsc *WSConn) Dropped(p Priority) int64 {
+	return wsc.out.droppedCount(p)
+}
+
 func (wsc *WSConn) In() <-chan *Message {
 	return wsc.inCh
 }
 
+// Send queues a text message with PriorityControl, so it's never dropped silently:
+// if the queue is full, Send returns ErrQueueFull.
 func (wsc *WSConn) Send(msg string) error {
-	tolog := msg
-	if len(tolog) > 500 {
-		tolog = tolog[:500] + "<...-truncated1-...>"
-	}
-	log.Printf("WSConn.Send(%s)", tolog)
-	return wsc.sock.WriteMessage([]byte(msg))
+	logger.Debug("WSConn.Send", "msg", msg)
+	return wsc.out.push(PriorityControl, &outMessage{typ: websocket.TextMessage, data: []byte(msg)})
+}
+
+// SendPriority queues a text message with the priority.
+func (wsc *WSConn) SendPriority(p Priority, msg string) error {
+	logger.Debug("WSConn.SendPriority", "priority", p.String(), "msg", msg)
+	return wsc.out.push(p, &outMessage{typ: websocket.TextMessage, data: []byte(msg)})
+}
+
+// SendBinary queues a binary message: file chunks with PriorityTransfer, everything else
+// (camera frames) with PriorityBulk. The data is copied.
+func (wsc *WSConn) SendBinary(data []byte) error {
+	logger.Debug("WSConn.SendBinary", "size", len(data))
+	return wsc.out.push(binaryPriority(data), &outMessage{typ: websocket.BinaryMessage, data: append([]byte(nil), data...)})
 }
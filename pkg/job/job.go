@@ -0,0 +1,208 @@
+// Package job defines the lifecycle of a print job, shared between the cloud and the agent.
+package job
+
+import (
+	"fmt"
+	"sync"
+)
+
+type State string
+
+const (
+	// None is the state of a device without a job.
+	None      State = ""
+	Queued    State = "queued"
+	Uploading State = "uploading"
+	Printing  State = "printing"
+	Paused    State = "paused"
+	Failed    State = "failed"
+	Cancelled State = "cancelled"
+	Done      State = "done"
+)
+
+var transitions = map[State][]State{
+	None:      {Queued, Uploading, Printing},
+	Queued:    {Uploading, Printing, Failed, Cancelled},
+	Uploading: {Queued, Printing, Failed, Cancelled},
+	Printing:  {Paused, Failed, Cancelled, Done},
+	Paused:    {Printing, Failed, Cancelled},
+	Failed:    {},
+	Cancelled: {},
+	Done:      {},
+}
+
+func (s State) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// Final reports whether the job is over (successfully or not).
+func (s State) Final() bool {
+	return s == Failed || s == Cancelled || s == Done
+}
+
+// CanTransition reports whether a job can go from one state to the other.
+func CanTransition(from, to State) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+type TransitionError struct {
+	JobName string
+	From    State
+	To      State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("job %q: impossible transition from %q to %q", e.JobName, e.From, e.To)
+}
+
+type EventType string
+
+const (
+	EventQueued        EventType = "job-queued"
+	EventUploadStarted EventType = "upload-started"
+	EventPrintStarted  EventType = "print-started"
+	EventPaused        EventType = "job-paused"
+	EventResumed       EventType = "job-resumed"
+	EventFailed        EventType = "job-failed"
+	EventCancelled     EventType = "job-cancelled"
+	EventFinished      EventType = "job-finished"
+)
+
+var eventTargets = map[EventType]State{
+	EventQueued:        Queued,
+	EventUploadStarted: Uploading,
+	EventPrintStarted:  Printing,
+	EventPaused:        Paused,
+	EventResumed:       Printing,
+	EventFailed:        Failed,
+	EventCancelled:     Cancelled,
+	EventFinished:      Done,
+}
+
+// Target returns the state of the job after the event.
+func (t EventType) Target() (State, bool) {
+	s, ok := eventTargets[t]
+	return s, ok
+}
+
+// Event is a change in the lifecycle of a job, reported by the device.
+type Event struct {
+	Type    EventType `json:"type"`
+	JobName string    `json:"jobName"`
+	// Milliseconds since the Unix epoch.
+	TS      int64  `json:"ts"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Machine tracks the state of a single job.
+type Machine struct {
+	JobName string
+	State   State
+}
+
+// Apply moves the job to the state defined by the event, or returns an error if it's impossible.
+func (m *Machine) Apply(ev *Event) error {
+	to, ok := ev.Type.Target()
+	if !ok {
+		return fmt.Errorf("job %q: unknown event type %q", ev.JobName, ev.Type)
+	}
+	if ev.JobName != m.JobName {
+		return fmt.Errorf("job %q: the event is for another job %q", m.JobName, ev.JobName)
+	}
+	if !CanTransition(m.State, to) {
+		return &TransitionError{JobName: m.JobName, From: m.State, To: to}
+	}
+	m.State = to
+	return nil
+}
+
+// PrinterStatus derives opapi.Printer.Status from the state of the current job.
+func PrinterStatus(s State) string {
+	if s == None {
+		return "idle"
+	}
+	return string(s)
+}
+
+// Tracker keeps the state of the current job for every device. It's safe for concurrent use.
+type Tracker struct {
+	// OnAbandoned, if set, is called when a device starts printing a new job while the current one
+	// is not over (e.g. the device lost it after a crash). The abandoned job is considered failed.
+	// It must be set before the Tracker is used.
+	OnAbandoned func(deviceName string, m Machine)
+
+	mu       sync.Mutex
+	machines map[string]*Machine
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{machines: make(map[string]*Machine)}
+}
+
+// nextLocked returns the job of the device after the event, and the abandoned job, if any.
+func (t *Tracker) nextLocked(deviceName string, ev *Event) (m Machine, abandoned *Machine, err error) {
+	cur, ok := t.machines[deviceName]
+	switch {
+	case !ok, cur.State.Final():
+		// A job with the same name might be printed again.
+		m = Machine{JobName: ev.JobName}
+	case cur.JobName == ev.JobName:
+		m = *cur
+	case ev.Type == EventPrintStarted:
+		abandoned = &Machine{JobName: cur.JobName, State: Failed}
+		m = Machine{JobName: ev.JobName}
+	default:
+		m = *cur
+	}
+	if err := m.Apply(ev); err != nil {
+		return Machine{}, nil, err
+	}
+	return m, abandoned, nil
+}
+
+// Check reports whether Apply would accept the event, without applying it.
+func (t *Tracker) Check(deviceName string, ev *Event) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, _, err := t.nextLocked(deviceName, ev)
+	return err
+}
+
+// Apply applies the event to the current job of the device, and returns the new state. An event
+// for a new job is only accepted when there is no job, the current one is over, or the new job
+// starts printing, in which case the current one is abandoned. On error, the state is unchanged.
+func (t *Tracker) Apply(deviceName string, ev *Event) (State, error) {
+	t.mu.Lock()
+	m, abandoned, err := t.nextLocked(deviceName, ev)
+	if err != nil {
+		state := None
+		if cur, ok := t.machines[deviceName]; ok {
+			state = cur.State
+		}
+		t.mu.Unlock()
+		return state, err
+	}
+	t.machines[deviceName] = &m
+	onAbandoned := t.OnAbandoned
+	t.mu.Unlock()
+	if abandoned != nil && onAbandoned != nil {
+		onAbandoned(deviceName, *abandoned)
+	}
+	return m.State, nil
+}
+
+// State returns the current job of the device and its state.
+func (t *Tracker) State(deviceName string) (jobName string, state State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if m, ok := t.machines[deviceName]; ok {
+		return m.JobName, m.State
+	}
+	return "", None
+}
@@ -0,0 +1,85 @@
+package job
+
+import "testing"
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to State
+		want     bool
+	}{
+		{None, Queued, true},
+		{Queued, Printing, true},
+		{Printing, Paused, true},
+		{Paused, Printing, true},
+		{Printing, Done, true},
+		{Paused, Done, false},
+		{Done, Printing, false},
+		{Failed, Queued, false},
+		{Paused, Cancelled, true},
+		{Cancelled, Printing, false},
+		{None, Done, false},
+	}
+	for _, tt := range tests {
+		if got := CanTransition(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanTransition(%q, %q): %v, want: %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTracker(t *testing.T) {
+	tr := NewTracker()
+	var abandoned []Machine
+	tr.OnAbandoned = func(deviceName string, m Machine) { abandoned = append(abandoned, m) }
+	apply := func(typ EventType, jobName string) error {
+		_, err := tr.Apply("w01", &Event{Type: typ, JobName: jobName})
+		return err
+	}
+	for _, typ := range []EventType{EventQueued, EventPrintStarted, EventPaused, EventResumed} {
+		if err := apply(typ, "a"); err != nil {
+			t.Fatalf("Apply(%q): %v", typ, err)
+		}
+	}
+	if err := apply(EventPaused, "b"); err == nil {
+		t.Errorf("An event for another job was accepted while the current one is printing")
+	}
+	if err := apply(EventQueued, "a"); err == nil {
+		t.Errorf("Printing -> queued transition was accepted")
+	} else if _, ok := err.(*TransitionError); !ok {
+		t.Errorf("Unexpected error type: %T (%v)", err, err)
+	}
+	if err := apply(EventFinished, "a"); err != nil {
+		t.Fatalf("Apply(finished): %v", err)
+	}
+	if jobName, state := tr.State("w01"); jobName != "a" || PrinterStatus(state) != "done" {
+		t.Errorf("State: %q, %q, want: a, done", jobName, state)
+	}
+	if state, err := tr.Apply("w01", &Event{Type: EventPaused, JobName: "a"}); err == nil || state != Done {
+		t.Errorf("Apply(paused) after done: %q, %v, want: done and an error", state, err)
+	}
+	if err := apply(EventPrintStarted, "b"); err != nil {
+		t.Errorf("A new job was not accepted after the previous one is done: %v", err)
+	}
+
+	// The device lost job b (e.g. it crashed) and started another one.
+	if err := apply(EventPrintStarted, "c"); err != nil {
+		t.Fatalf("A new job was not accepted after the previous one was abandoned: %v", err)
+	}
+	if want := []Machine{{JobName: "b", State: Failed}}; len(abandoned) != 1 || abandoned[0] != want[0] {
+		t.Errorf("Abandoned jobs: %+v, want: %+v", abandoned, want)
+	}
+	if err := apply(EventCancelled, "c"); err != nil {
+		t.Errorf("Apply(cancelled): %v", err)
+	}
+	if jobName, state := tr.State("w01"); jobName != "c" || state != Cancelled {
+		t.Errorf("State: %q, %q, want: c, cancelled", jobName, state)
+	}
+	// The same job is printed again.
+	for _, typ := range []EventType{EventPrintStarted, EventFinished, EventPrintStarted} {
+		if err := apply(typ, "c"); err != nil {
+			t.Fatalf("Apply(%q) of a reprinted job: %v", typ, err)
+		}
+	}
+	if jobName, state := tr.State("w01"); jobName != "c" || state != Printing {
+		t.Errorf("State: %q, %q, want: c, printing", jobName, state)
+	}
+}
@@ -0,0 +1,209 @@
+// Package logging provides leveled structured loggers (log/slog) for the packages of this library.
+//
+// Every package gets its logger with For, and the application configures all of them at once:
+// SetHandler sets the destination, SetLevel and SetDefaultLevel control the verbosity per package.
+// Cookies, tokens and camera payloads are redacted from the logged attributes and messages.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	mu sync.RWMutex
+	// Nil means slog.Default().Handler(), which writes to the standard logger.
+	handler      slog.Handler
+	defaultLevel = new(slog.LevelVar)
+	levels       = make(map[string]*slog.LevelVar)
+)
+
+// SetHandler sets the destination of all loggers. Nil restores the default: slog.Default().
+func SetHandler(h slog.Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handler = h
+}
+
+// SetDefaultLevel sets the level of the packages without their own level. It's slog.LevelInfo by default.
+func SetDefaultLevel(level slog.Level) {
+	defaultLevel.Set(level)
+}
+
+// SetLevel sets the level of the package, like "device_api".
+func SetLevel(pkg string, level slog.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	lv, ok := levels[pkg]
+	if !ok {
+		lv = new(slog.LevelVar)
+		levels[pkg] = lv
+	}
+	lv.Set(level)
+}
+
+// ParseLevels applies a spec like "info,device_api=debug,syncws=warn", suitable for a command line flag.
+// An entry without a package sets the default level.
+func ParseLevels(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pkg, levelStr := "", entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			pkg, levelStr = entry[:i], entry[i+1:]
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelStr)); err != nil {
+			return fmt.Errorf("invalid log level in %q: %v", entry, err)
+		}
+		if pkg == "" {
+			SetDefaultLevel(level)
+		} else {
+			SetLevel(pkg, level)
+		}
+	}
+	return nil
+}
+
+func levelOf(pkg string) slog.Level {
+	mu.RLock()
+	lv, ok := levels[pkg]
+	mu.RUnlock()
+	if ok {
+		return lv.Level()
+	}
+	return defaultLevel.Level()
+}
+
+func currentHandler() slog.Handler {
+	mu.RLock()
+	h := handler
+	mu.RUnlock()
+	if h == nil {
+		return slog.Default().Handler()
+	}
+	return h
+}
+
+// For returns the logger of the package. The logger follows the later calls to SetHandler and SetLevel,
+// so it's fine to keep it in a package variable.
+func For(pkg string) *slog.Logger {
+	return slog.New(&pkgHandler{pkg: pkg})
+}
+
+// pkgHandler resolves the destination and the level at the time of logging.
+type pkgHandler struct {
+	pkg string
+	// WithAttrs and WithGroup calls, replayed on the current handler.
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *pkgHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= levelOf(h.pkg) && currentHandler().Enabled(ctx, level)
+}
+
+func (h *pkgHandler) Handle(ctx context.Context, r slog.Record) error {
+	res := slog.NewRecord(r.Time, r.Level, RedactString(r.Message), r.PC)
+	res.AddAttrs(slog.String("pkg", h.pkg))
+	r.Attrs(func(a slog.Attr) bool {
+		res.AddAttrs(redactAttr(a))
+		return true
+	})
+	base := currentHandler()
+	for _, op := range h.ops {
+		base = op(base)
+	}
+	return base.Handle(ctx, res)
+}
+
+func (h *pkgHandler) with(op func(slog.Handler) slog.Handler) *pkgHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &pkgHandler{pkg: h.pkg, ops: append(ops, op)}
+}
+
+func (h *pkgHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	res := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		res[i] = redactAttr(a)
+	}
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithAttrs(res) })
+}
+
+func (h *pkgHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithGroup(name) })
+}
+
+const redacted = "[REDACTED]"
+
+// sensitiveKey reports whether the values of the attribute or the JSON field must not be logged.
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	return strings.Contains(key, "cookie") || strings.Contains(key, "token") ||
+		strings.Contains(key, "password") || strings.Contains(key, "secret")
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	if sensitiveKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, RedactString(v.String()))
+	case slog.KindGroup:
+		attrs := v.Group()
+		res := make([]any, len(attrs))
+		for i, ga := range attrs {
+			res[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, res...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case []byte:
+			return slog.String(a.Key, fmt.Sprintf("[%d bytes]", len(x)))
+		case error:
+			return slog.String(a.Key, RedactString(x.Error()))
+		}
+	}
+	return a
+}
+
+var (
+	sensitiveFieldRe = regexp.MustCompile(`"([A-Za-z_]*(?i:cookie|token|password|secret)[A-Za-z_]*)"\s*:\s*"(?:[^"\\]|\\.)*"`)
+	dataURLRe        = regexp.MustCompile(`"data:[^"]*"`)
+)
+
+// MaxStringLen limits the length of the logged strings, like the messages received from the other side.
+const MaxStringLen = 500
+
+// RedactString removes the values of the sensitive fields and camera payloads (data URLs)
+// from a JSON message, and truncates it to MaxStringLen.
+func RedactString(s string) string {
+	lower := strings.ToLower(s)
+	if strings.Contains(lower, "cookie") || strings.Contains(lower, "token") ||
+		strings.Contains(lower, "password") || strings.Contains(lower, "secret") {
+		s = sensitiveFieldRe.ReplaceAllString(s, `"$1":"`+redacted+`"`)
+	}
+	if strings.Contains(s, `"data:`) {
+		s = dataURLRe.ReplaceAllStringFunc(s, func(m string) string {
+			return fmt.Sprintf(`"[data URL, %d bytes]"`, len(m)-2)
+		})
+	}
+	if len(s) > MaxStringLen {
+		// Don't cut a multi-byte character in half.
+		n := MaxStringLen
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n] + "<...truncated...>"
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRedactString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: `{"cmd":"hello","cookie":"abc\"def","jobName":"j"}`, want: `{"cmd":"hello","cookie":"[REDACTED]","jobName":"j"}`},
+		{in: `{"login":{"Cookie": "abc"}}`, want: `{"login":{"Cookie":"[REDACTED]"}}`},
+		{in: `{"userToken":"x","b":"y"}`, want: `{"userToken":"[REDACTED]","b":"y"}`},
+		{in: `{"cameras":[{"data":"data:image/jpeg;base64,AAAA"}]}`, want: `{"cameras":[{"data":"[data URL, 27 bytes]"}]}`},
+		{in: `no secrets here`, want: `no secrets here`},
+	}
+	for _, tt := range tests {
+		if got := RedactString(tt.in); got != tt.want {
+			t.Errorf("RedactString(%q): %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	long := strings.Repeat("a", 2*MaxStringLen)
+	if got := RedactString(long); len(got) > MaxStringLen+20 {
+		t.Errorf("RedactString did not truncate a long string: %d bytes", len(got))
+	}
+	// The cut falls in the middle of a 3-byte character.
+	long = "a" + strings.Repeat("ж€", MaxStringLen)
+	if got := RedactString(long); !utf8.ValidString(got) {
+		t.Errorf("RedactString cut a character in half: %q", got[MaxStringLen-3:])
+	}
+}
+
+func TestLevelsAndRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	SetHandler(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	defer SetHandler(nil)
+	if err := ParseLevels("warn, foo=debug"); err != nil {
+		t.Fatalf("ParseLevels: %v", err)
+	}
+	defer SetDefaultLevel(slog.LevelInfo)
+	if err := ParseLevels("foo=loud"); err == nil {
+		t.Errorf("ParseLevels accepted an invalid level")
+	}
+
+	foo, bar := For("foo"), For("bar")
+	bar.Info("bar info")
+	foo.Debug("foo debug", "cookie", "c1", "err", errors.New(`bad "token":"t1"`), "frame", []byte{1, 2, 3})
+	foo.With("userToken", "t2").Info("with")
+	out := buf.String()
+
+	if strings.Contains(out, "bar info") {
+		t.Errorf("bar logged at info with the default level warn: %s", out)
+	}
+	for _, s := range []string{"foo debug", "pkg=foo", "cookie=[REDACTED]", "userToken=[REDACTED]", `frame="[3 bytes]"`} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q not found in the log: %s", s, out)
+		}
+	}
+	for _, s := range []string{"c1", "t1", "t2"} {
+		if strings.Contains(out, s) {
+			t.Errorf("%q leaked into the log: %s", s, out)
+		}
+	}
+}
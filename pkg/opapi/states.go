@@ -0,0 +1,94 @@
+package opapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// MovingState is the state of the motion system of a printer.
+// Values unknown to this version are preserved as is, so that older (or newer) agents keep working.
+type MovingState string
+
+const (
+	MovingStateUnknown MovingState = ""
+	MovingStateIdle    MovingState = "idle"
+	MovingStateMoving  MovingState = "moving"
+	MovingStateHoming  MovingState = "homing"
+	MovingStateStopped MovingState = "stopped"
+)
+
+var knownMovingStates = map[MovingState]bool{
+	MovingStateUnknown: true,
+	MovingStateIdle:    true,
+	MovingStateMoving:  true,
+	MovingStateHoming:  true,
+	MovingStateStopped: true,
+}
+
+func (s MovingState) Known() bool {
+	return knownMovingStates[s]
+}
+
+func (s *MovingState) UnmarshalJSON(data []byte) error {
+	str, err := unmarshalState(data, "moving state")
+	if err != nil {
+		return err
+	}
+	if norm := MovingState(normalizeState(str)); norm.Known() {
+		*s = norm
+		return nil
+	}
+	*s = MovingState(str)
+	return nil
+}
+
+// GripperState is the state of the gripper of a printer.
+// Values unknown to this version are preserved as is, so that older (or newer) agents keep working.
+type GripperState string
+
+const (
+	GripperStateUnknown GripperState = ""
+	GripperStateOpen    GripperState = "open"
+	GripperStateClosed  GripperState = "closed"
+)
+
+var knownGripperStates = map[GripperState]bool{
+	GripperStateUnknown: true,
+	GripperStateOpen:    true,
+	GripperStateClosed:  true,
+}
+
+func (s GripperState) Known() bool {
+	return knownGripperStates[s]
+}
+
+func (s *GripperState) UnmarshalJSON(data []byte) error {
+	str, err := unmarshalState(data, "gripper state")
+	if err != nil {
+		return err
+	}
+	if norm := GripperState(normalizeState(str)); norm.Known() {
+		*s = norm
+		return nil
+	}
+	*s = GripperState(str)
+	return nil
+}
+
+// unmarshalState accepts a JSON string or null.
+func unmarshalState(data []byte, what string) (string, error) {
+	if string(data) == "null" {
+		return "", nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return "", fmt.Errorf("invalid %s %s: must be a string", what, string(data))
+	}
+	return str, nil
+}
+
+// normalizeState makes "Idle " and "idle" the same.
+func normalizeState(s string) string {
+	return strings.ToLower(strings.TrimSpace(s))
+}
@@ -0,0 +1,33 @@
+package opapi
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStatesJSON(t *testing.T) {
+	var p struct {
+		PrinterForMovingState
+		PrinterForGripperState
+	}
+	if err := json.Unmarshal([]byte(`{"movingState":" Homing","gripperState":"half-open"}`), &p); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if p.MovingState != MovingStateHoming {
+		t.Errorf("MovingState: %q, want: %q", p.MovingState, MovingStateHoming)
+	}
+	// Unknown values are preserved for backwards compatibility.
+	if p.GripperState != "half-open" || p.GripperState.Known() {
+		t.Errorf("GripperState: %q (known: %v), want: unknown half-open", p.GripperState, p.GripperState.Known())
+	}
+	data, err := json.Marshal(&p)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if want := `{"movingState":"homing","pose":null,"gripperState":"half-open"}`; string(data) != want {
+		t.Errorf("Marshal: %s, want: %s", data, want)
+	}
+	if err := json.Unmarshal([]byte(`{"movingState":5}`), &p); err == nil {
+		t.Errorf("A number was accepted as a moving state")
+	}
+}
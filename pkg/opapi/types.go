@@ -26,12 +26,12 @@ type PrinterForVideo struct {
 }
 
 type PrinterForMovingState struct {
-	MovingState string    `json:"movingState"`
-	Pose        []float64 `json:"pose"`
+	MovingState MovingState `json:"movingState"`
+	Pose        []float64   `json:"pose"`
 }
 
 type PrinterForGripperState struct {
-	GripperState string `json:"gripperState"`
+	GripperState GripperState `json:"gripperState"`
 }
 
 type PrinterForCameras struct {
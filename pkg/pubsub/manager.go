@@ -1,97 +1,171 @@
 package pubsub
 
 import (
-	"log"
+	"hash/fnv"
 	"sync"
 )
 
 const universalSubStart = 1E10
 
-type Manager struct {
+// The number of independently locked parts of the node map. Publishing to different nodes
+// only contends on a shard lock, if the nodes happen to belong to the same shard.
+const numShards = 32
+
+type shard struct {
 	mu    sync.Mutex
 	nodes map[string]*Node
-	subs  map[*Sub]string
+}
 
+type Manager struct {
+	// uniMu guards the fields below. If both uniMu and a shard lock are needed,
+	// uniMu must be taken first.
+	uniMu   sync.Mutex
+	stopped bool
 	// List of subs subscribed to all current and future nodes.
 	uniSubs   map[*Sub]bool
 	cnt       int64
 	initPaths []string
+
+	shards [numShards]shard
 }
 
 func NewManager(initPaths ...string) *Manager {
-	return &Manager{
-		nodes:     make(map[string]*Node),
-		subs:      make(map[*Sub]string),
+	m := &Manager{
 		uniSubs:   make(map[*Sub]bool),
 		cnt:       universalSubStart,
 		initPaths: initPaths,
 	}
+	for i := range m.shards {
+		m.shards[i].nodes = make(map[string]*Node)
+	}
+	return m
 }
 
-func (m *Manager) getNode(nodeName string) *Node {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	node, ok := m.nodes[nodeName]
+func (m *Manager) shardFor(nodeName string) *shard {
+	h := fnv.New32a()
+	h.Write([]byte(nodeName))
+	return &m.shards[h.Sum32()%numShards]
+}
+
+func (m *Manager) getNode(nodeName string) (*Node, error) {
+	sh := m.shardFor(nodeName)
+	sh.mu.Lock()
+	node, ok := sh.nodes[nodeName]
+	sh.mu.Unlock()
+	if ok {
+		return node, nil
+	}
+
+	// Slow path: the node has to be created and subscribed to all universal subs.
+	m.uniMu.Lock()
+	defer m.uniMu.Unlock()
+	if m.stopped {
+		return nil, ErrNodeAlreadyStopped
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	node, ok = sh.nodes[nodeName]
 	if !ok {
 		node = NewNode(m.initPaths...)
-		m.nodes[nodeName] = node
+		sh.nodes[nodeName] = node
 		for sub := range m.uniSubs {
 			if err := node.subSub(sub, sub.paths...); err != nil && err != ErrNodeAlreadyStopped {
 				// TODO(krasin): do something about it
-				log.Printf("Failed to subscribe a node to universal sub with paths: %q, err: %v", sub.paths, err)
+				logger.Error("Failed to subscribe a node to a universal sub", "paths", sub.paths, "err", err)
 			}
 		}
 	}
-	return node
+	return node, nil
 }
 
 func (m *Manager) Sub(nodeName string, paths ...string) (*Sub, error) {
-	// log.Printf("Manager.Sub(%q, %q)", nodeName, paths)
-	sub, err := m.getNode(nodeName).Sub(paths...)
+	node, err := m.getNode(nodeName)
 	if err != nil {
 		return nil, err
 	}
-	m.subs[sub] = nodeName
-	return sub, err
+	return node.Sub(paths...)
 }
 
 // SubAll subscribes to all current or future nodes for the specified paths.
 func (m *Manager) SubAll(paths ...string) (*Sub, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.uniMu.Lock()
+	defer m.uniMu.Unlock()
+	if m.stopped {
+		return nil, ErrNodeAlreadyStopped
+	}
 	// TODO(krasin): validate paths. They must be conforming json rules.
 	paths = cleanPaths(paths)
-	ch := make(chan string, backlogSize)
 	m.cnt++
-	res := &Sub{paths: paths, ch: ch, id: m.cnt}
-	for _, node := range m.nodes {
-		if err := node.subSub(res, res.paths...); err != nil && err != ErrNodeAlreadyStopped {
-			// TODO(krasin): properly call Unsub on already subscribed nodes.
-			return nil, err
+	res := newSub(m.cnt, paths)
+	res.ch = make(chan string, backlogSize)
+	res.universal = true
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		for _, node := range sh.nodes {
+			if err := node.subSub(res, res.paths...); err != nil && err != ErrNodeAlreadyStopped {
+				sh.mu.Unlock()
+				// TODO(krasin): properly call Unsub on already subscribed nodes.
+				return nil, err
+			}
 		}
+		sh.mu.Unlock()
 	}
 	m.uniSubs[res] = true
 	return res, nil
 }
 
 func (m *Manager) Pub(nodeName, jsonStr string) error {
-	return m.getNode(nodeName).Pub(jsonStr)
+	node, err := m.getNode(nodeName)
+	if err != nil {
+		return err
+	}
+	return node.Pub(jsonStr)
 }
 
 func (m *Manager) Unsub(sub *Sub) {
-	nodeName := m.subs[sub]
-	if nodeName == "" {
+	if sub.node == nil {
+		// Universal subs live until the manager is stopped.
 		return
 	}
-	delete(m.subs, sub)
-	m.getNode(nodeName).Unsub(sub)
+	sub.node.Unsub(sub)
+}
+
+// Flush blocks until all the updates published before the call are delivered to subscribers.
+func (m *Manager) Flush() {
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		nodes := make([]*Node, 0, len(sh.nodes))
+		for _, node := range sh.nodes {
+			nodes = append(nodes, node)
+		}
+		sh.mu.Unlock()
+		for _, node := range nodes {
+			node.Flush()
+		}
+	}
 }
 
 func (m *Manager) Stop() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	for _, node := range m.nodes {
-		node.Stop()
+	m.uniMu.Lock()
+	defer m.uniMu.Unlock()
+	if m.stopped {
+		return
+	}
+	m.stopped = true
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.mu.Lock()
+		for _, node := range sh.nodes {
+			node.Stop()
+		}
+		sh.nodes = nil
+		sh.mu.Unlock()
+	}
+	// All nodes are stopped, so nobody can send to universal subs anymore.
+	for sub := range m.uniSubs {
+		close(sub.ch)
 	}
-	m.nodes = nil
+	m.uniSubs = nil
 }
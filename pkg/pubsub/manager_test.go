@@ -1,6 +1,9 @@
 package pubsub
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+)
 
 func TestManagerSimple(t *testing.T) {
 	m := NewManager()
@@ -14,6 +17,7 @@ func TestManagerSimple(t *testing.T) {
 	if err := m.Pub("zzz", update); err != nil {
 		t.Fatalf("Pub: %v", err)
 	}
+	m.Flush()
 	select {
 	case msg := <-sub.C():
 		t.Errorf("Unexpected update: %v", msg)
@@ -23,6 +27,7 @@ func TestManagerSimple(t *testing.T) {
 	if err := m.Pub("hello@world.com", update); err != nil {
 		t.Fatalf("Pub2: %v", err)
 	}
+	m.Flush()
 	select {
 	case msg := <-sub.C():
 		if msg != update {
@@ -33,3 +38,37 @@ func TestManagerSimple(t *testing.T) {
 	}
 	m.Unsub(sub)
 }
+
+// Test that a universal sub receives updates from all nodes and is closed exactly once on Stop.
+func TestManagerSubAll(t *testing.T) {
+	m := NewManager()
+
+	if err := m.Pub("a", `{"printers":{"a1":{"online":true}}}`); err != nil {
+		t.Fatalf("Pub: %v", err)
+	}
+	sub, err := m.SubAll("printers")
+	if err != nil {
+		t.Fatalf("SubAll: %v", err)
+	}
+	if err := m.Pub("b", `{"printers":{"b1":{"online":false}}}`); err != nil {
+		t.Fatalf("Pub2: %v", err)
+	}
+	m.Flush()
+	var got []string
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-sub.C():
+			got = append(got, msg)
+		default:
+			t.Fatalf("Expected update #%d not received", i)
+		}
+	}
+	want := []string{`{"printers":{"a1":{"online":true}}}`, `{"printers":{"b1":{"online":false}}}`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected updates: %q, want: %q", got, want)
+	}
+	m.Stop()
+	if _, ok := <-sub.C(); ok {
+		t.Errorf("Universal sub is not closed after Stop")
+	}
+}
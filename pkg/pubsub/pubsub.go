@@ -4,11 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+
+	"github.com/robodone/robosla-common/pkg/logging"
 )
 
 // Right now, backlog is implemented poorly, as if it's full, it's the new messages
@@ -16,8 +17,20 @@ import (
 // Update: in fact, it's not that large. Messages may come in bursts. 30 was not enough.
 const backlogSize = 50
 
+// The size of the queue between publishers and the dispatch goroutine of a node.
+// If it's full, Pub blocks until the dispatcher catches up.
+const dispatchQueueSize = 256
+
+var logger = logging.For("pubsub")
+
 var ErrNodeAlreadyStopped = errors.New("node is already stopped")
 
+// Node keeps a JSON-like state and notifies subscribers about the changes in it.
+//
+// The state is copy-on-write: Pub never modifies an object that was already published,
+// it copies the objects on the changed paths instead. This allows to keep the critical
+// section short (merge the update and find interested subscribers), while marshalling
+// and delivering the updates is done by the dispatch goroutine of the node.
 type Node struct {
 	mu       sync.Mutex
 	stopped  bool
@@ -25,31 +38,108 @@ type Node struct {
 	subPaths map[string][]*Sub
 	subs     []*Sub
 	state    map[string]interface{}
+
+	events chan *event
+	done   chan bool
+}
+
+type eventKind int
+
+const (
+	eventUpdate eventKind = iota
+	eventUnsub
+	eventFlush
+	eventStop
+)
+
+type event struct {
+	kind eventKind
+	// The update to deliver (eventUpdate).
+	m map[string]interface{}
+	// Subs to deliver the update to (eventUpdate), to close (eventUnsub, eventStop).
+	subs []*Sub
+	// Closed once the event is processed (eventFlush).
+	flushed chan bool
 }
 
 func NewNode(initPaths ...string) *Node {
 	res := &Node{
 		subPaths: make(map[string][]*Sub),
 		state:    make(map[string]interface{}),
+		events:   make(chan *event, dispatchQueueSize),
+		done:     make(chan bool),
 	}
 	for _, p := range initPaths {
 		pp := strings.Split(p, ".")
 		setIfCan(res.state, pp, make(map[string]interface{}))
 	}
+	go res.dispatch()
 	return res
 }
 
+// dispatch delivers updates to subscribers in the order they were published.
+// It's the only place where the channels of subs owned by the node are closed.
+func (nd *Node) dispatch() {
+	defer close(nd.done)
+	for ev := range nd.events {
+		switch ev.kind {
+		case eventUpdate:
+			// Subs with the same set of paths receive the same payload, so it's marshalled only once.
+			payloads := make(map[string]string)
+			for _, sub := range ev.subs {
+				sub.updateCached(ev.m, payloads)
+			}
+		case eventUnsub:
+			for _, sub := range ev.subs {
+				sub.close()
+			}
+		case eventFlush:
+			close(ev.flushed)
+		case eventStop:
+			for _, sub := range ev.subs {
+				sub.close()
+			}
+			return
+		}
+	}
+}
+
+// Stop closes all subscriptions to the node (except universal subs owned by Manager)
+// and waits for the pending updates to be delivered.
 func (nd *Node) Stop() {
 	nd.mu.Lock()
-	defer nd.mu.Unlock()
-
+	if nd.stopped {
+		nd.mu.Unlock()
+		return
+	}
+	var owned []*Sub
 	for _, sub := range nd.subs {
-		close(sub.ch)
+		if !sub.universal {
+			owned = append(owned, sub)
+		}
 	}
+	nd.events <- &event{kind: eventStop, subs: owned}
 	nd.stopped = true
 	nd.subPaths = nil
 	nd.subs = nil
 	nd.state = nil
+	nd.mu.Unlock()
+
+	<-nd.done
+}
+
+// Flush blocks until all the updates published before the call are delivered to subscribers.
+func (nd *Node) Flush() {
+	nd.mu.Lock()
+	if nd.stopped {
+		nd.mu.Unlock()
+		return
+	}
+	flushed := make(chan bool)
+	nd.events <- &event{kind: eventFlush, flushed: flushed}
+	nd.mu.Unlock()
+
+	<-flushed
 }
 
 type subSlice []*Sub
@@ -89,37 +179,40 @@ func scanPaths(m map[string]interface{}) []string {
 }
 
 func (nd *Node) Pub(jsonStr string) error {
-	nd.mu.Lock()
-	defer nd.mu.Unlock()
-	if nd.stopped {
-		return ErrNodeAlreadyStopped
-	}
-	// log.Printf("Pub(%s), prior state: %s", jsonStr, mustJson(nd.state))
+	// Parsing is done before taking the lock, as it's the most expensive part.
 	var m map[string]interface{}
 	if err := json.Unmarshal([]byte(jsonStr), &m); err != nil {
 		return err
 	}
+	return nd.PubMap(m)
+}
+
+// PubMap is Pub of an already decoded JSON object, for the callers which need to look into
+// the update themselves. m must not be modified afterwards.
+func (nd *Node) PubMap(m map[string]interface{}) error {
 	paths := scanPaths(m)
-	// log.Printf("Pub, paths: %v", paths)
+
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	if nd.stopped {
+		return ErrNodeAlreadyStopped
+	}
 	subsM := make(map[*Sub]bool)
 	for _, p := range paths {
-		// log.Printf("Pub, p=%q, len(nd.subPaths[p]): %d", p, len(nd.subPaths[p]))
 		for _, sub := range nd.subPaths[p] {
 			subsM[sub] = true
 		}
-		assignIfCan(nd.state, m, p)
 	}
-	// log.Printf("Pub, found %d subs", len(subsM))
+	nd.state = mergeCopy(nd.state, m)
+	if len(subsM) == 0 {
+		return nil
+	}
 	var subs []*Sub
-	for sub, _ := range subsM {
+	for sub := range subsM {
 		subs = append(subs, sub)
 	}
 	sort.Sort(subSlice(subs))
-	for _, sub := range subs {
-		sub.update(m)
-	}
-
-	// log.Printf("Pub(%s), after state: %s", jsonStr, mustJson(nd.state))
+	nd.events <- &event{kind: eventUpdate, m: m, subs: subs}
 	return nil
 }
 
@@ -156,9 +249,10 @@ func (nd *Node) Sub(paths ...string) (*Sub, error) {
 	}
 	// TODO(krasin): validate paths. They must be conforming json rules.
 	paths = cleanPaths(paths)
-	ch := make(chan string, backlogSize)
 	nd.cnt++
-	res := &Sub{paths: paths, ch: ch, id: nd.cnt}
+	res := newSub(nd.cnt, paths)
+	res.ch = make(chan string, backlogSize)
+	res.node = nd
 	err := nd.subInternal(res, paths...)
 	if err != nil {
 		return nil, err
@@ -166,11 +260,31 @@ func (nd *Node) Sub(paths ...string) (*Sub, error) {
 	return res, nil
 }
 
+// SubValue subscribes to a single path and receives its decoded values, without
+// a marshal/unmarshal round trip.
+func (nd *Node) SubValue(path string) (*ValueSub, error) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	if nd.stopped {
+		return nil, ErrNodeAlreadyStopped
+	}
+	nd.cnt++
+	sub := newSub(nd.cnt, []string{path})
+	sub.vals = make(chan interface{}, backlogSize)
+	sub.node = nd
+	if err := nd.subInternal(sub, path); err != nil {
+		return nil, err
+	}
+	return &ValueSub{nd: nd, sub: sub}, nil
+}
+
 func (nd *Node) subInternal(sub *Sub, paths ...string) error {
 	for _, p := range paths {
 		nd.subPaths[p] = append(nd.subPaths[p], sub)
 	}
 	nd.subs = append(nd.subs, sub)
+	// The initial update is sent directly: the sub is not known to the dispatcher yet,
+	// and all the updates queued after this point will be delivered after this one.
 	sub.update(nd.state)
 	return nil
 }
@@ -185,27 +299,20 @@ func (nd *Node) subSub(sub *Sub, paths ...string) error {
 }
 
 func (nd *Node) SubString(path string) (*StringSub, error) {
-	sub, err := nd.Sub(path)
+	vs, err := nd.SubValue(path)
 	if err != nil {
 		return nil, err
 	}
-	return newStringSub(nd, sub, path), nil
+	return newStringSub(vs, path), nil
 }
 
-func removeSub(subs []*Sub, sub *Sub, shouldClose bool) []*Sub {
+func removeSub(subs []*Sub, sub *Sub) []*Sub {
 	for i := 0; i < len(subs); i++ {
-		v := subs[i]
-		if v != sub {
+		if subs[i] != sub {
 			continue
 		}
-		if shouldClose {
-			close(v.ch)
-		}
 		subs[i] = subs[len(subs)-1]
 		subs = subs[:len(subs)-1]
-		if i == len(subs)-1 {
-			break
-		}
 		i--
 	}
 	return subs
@@ -217,24 +324,72 @@ func (nd *Node) Unsub(sub *Sub) {
 	if nd.stopped {
 		return
 	}
+	found := false
+	for _, v := range nd.subs {
+		if v == sub {
+			found = true
+			break
+		}
+	}
+	if !found {
+		// Already unsubscribed.
+		return
+	}
 
 	// Dumb: scan everything and delete from everywhere.
-	nd.subs = removeSub(nd.subs, sub, true)
+	nd.subs = removeSub(nd.subs, sub)
 	for p, subs := range nd.subPaths {
-		nd.subPaths[p] = removeSub(subs, sub, false)
+		nd.subPaths[p] = removeSub(subs, sub)
+	}
+	if !sub.universal {
+		// The channel is closed by the dispatcher, after all the pending updates for this sub are handled.
+		nd.events <- &event{kind: eventUnsub, subs: []*Sub{sub}}
 	}
 }
 
+// Sub is a subscription to a set of paths. Depending on how it was created, it either receives
+// JSON-encoded subsets of the updates (ch), or the decoded values of its only path (vals).
 type Sub struct {
 	id    int64
 	paths []string
-	ch    chan string
+	// Split paths, to avoid splitting them on every update.
+	pp [][]string
+	// Subs with the same key receive the same payloads.
+	key  string
+	ch   chan string
+	vals chan interface{}
+
+	// The node this sub belongs to. It's nil for universal subs.
+	node *Node
+	// Universal subs are shared by all nodes of a Manager, and their channels are closed by the Manager.
+	universal bool
+}
+
+func newSub(id int64, paths []string) *Sub {
+	pp := make([][]string, len(paths))
+	for i, p := range paths {
+		pp[i] = strings.Split(p, ".")
+	}
+	return &Sub{
+		id:    id,
+		paths: paths,
+		pp:    pp,
+		key:   strings.Join(paths, "\x00"),
+	}
 }
 
 func (s *Sub) C() <-chan string {
 	return s.ch
 }
 
+func (s *Sub) close() {
+	if s.vals != nil {
+		close(s.vals)
+		return
+	}
+	close(s.ch)
+}
+
 func getIfCan(m map[string]interface{}, pp []string) (interface{}, bool) {
 	switch len(pp) {
 	case 0:
@@ -251,7 +406,7 @@ func getIfCan(m map[string]interface{}, pp []string) (interface{}, bool) {
 		case map[string]interface{}:
 			return getIfCan(val.(map[string]interface{}), pp[1:])
 		case []interface{}:
-			log.Printf("Error: getIfCan: arrays not implemented. Skip.")
+			logger.Error("getIfCan: arrays not implemented. Skip.")
 			return nil, false
 		default:
 			// Simple value. We can't go inside.
@@ -280,6 +435,25 @@ func mergeObjects(dest, src map[string]interface{}) {
 	}
 }
 
+// mergeCopy returns the result of a deep merge of src into dest. Neither dest nor src are modified,
+// only the objects on the changed paths are copied.
+func mergeCopy(dest, src map[string]interface{}) map[string]interface{} {
+	res := make(map[string]interface{}, len(dest)+len(src))
+	for k, v := range dest {
+		res[k] = v
+	}
+	for k, val := range src {
+		if srcObj, ok := val.(map[string]interface{}); ok {
+			if destObj, ok := res[k].(map[string]interface{}); ok {
+				res[k] = mergeCopy(destObj, srcObj)
+				continue
+			}
+		}
+		res[k] = val
+	}
+	return res
+}
+
 func setIfCan(m map[string]interface{}, pp []string, val interface{}) {
 	// log.Printf("setIfCan(m: %+v, pp: %q, val: %+v", m, pp, val)
 	if len(pp) == 1 {
@@ -309,7 +483,7 @@ func setIfCan(m map[string]interface{}, pp []string, val interface{}) {
 				m[pp[0]] = val
 			}
 		default:
-			log.Printf("Unsupported value type: %v", val)
+			logger.Error("Unsupported value type", "value", val)
 		}
 		return
 	}
@@ -327,7 +501,10 @@ func assignIfCan(dest, src map[string]interface{}, p string) {
 	if p == "" {
 		return
 	}
-	pp := strings.Split(p, ".")
+	assignPathIfCan(dest, src, strings.Split(p, "."))
+}
+
+func assignPathIfCan(dest, src map[string]interface{}, pp []string) {
 	val, ok := getIfCan(src, pp)
 	if !ok {
 		// this path is not present in src. Skip.
@@ -337,32 +514,78 @@ func assignIfCan(dest, src map[string]interface{}, p string) {
 }
 
 func (s *Sub) update(m map[string]interface{}) {
+	s.updateCached(m, nil)
+}
+
+// updateCached delivers the relevant subset of m to the sub. If payloads is not nil,
+// it's used to share marshalled payloads between subs with the same set of paths.
+func (s *Sub) updateCached(m map[string]interface{}, payloads map[string]string) {
+	if s.vals != nil {
+		s.updateValue(m)
+		return
+	}
+	msg, ok := payloads[s.key]
+	if !ok {
+		msg = s.payload(m)
+		if payloads != nil {
+			payloads[s.key] = msg
+		}
+	}
+	if msg == "{}" {
+		// Skip an empty update.
+		return
+	}
+	select {
+	case s.ch <- msg:
+	default:
+		logger.Warn("Failed to publish update", "paths", s.paths, "msg", msg)
+		// The destination has lost this update, but we don't want to lock on them anyway.
+	}
+}
+
+func (s *Sub) payload(m map[string]interface{}) string {
 	// We need to create a subset of m to only notify about the changes in the subscribed paths.
 	res := make(map[string]interface{})
-	// TODO(krasin): implement
-	for _, p := range s.paths {
-		assignIfCan(res, m, p)
+	for _, pp := range s.pp {
+		assignPathIfCan(res, m, pp)
 	}
 	data, err := json.Marshal(res)
 	if err != nil {
 		panic(fmt.Errorf("update: failed to marshal: %v", err))
 	}
-	msg := string(data)
-	if msg == "{}" {
-		// Skip an empty update.
+	return string(data)
+}
+
+func (s *Sub) updateValue(m map[string]interface{}) {
+	val, ok := getIfCan(m, s.pp[0])
+	if !ok {
+		// The path is not present in the update.
 		return
 	}
 	select {
-	case s.ch <- msg:
+	case s.vals <- val:
 	default:
-		log.Printf("Failed to publish update for sub(%q): %s", s.paths, msg)
-		// The destination has lost this update, but we don't want to lock on them anyway.
+		logger.Warn("Failed to publish value update", "paths", s.paths)
 	}
 }
 
+// ValueSub receives the values of a single path. The values are shared with the state
+// of the node and with other subscribers, so they must not be modified.
+type ValueSub struct {
+	nd  *Node
+	sub *Sub
+}
+
+func (vs *ValueSub) C() <-chan interface{} {
+	return vs.sub.vals
+}
+
+func (vs *ValueSub) Unsub() {
+	vs.nd.Unsub(vs.sub)
+}
+
 type StringSub struct {
-	nd   *Node
-	sub  *Sub
+	vs   *ValueSub
 	path string
 	ch   chan string
 }
@@ -371,10 +594,9 @@ func (ss *StringSub) C() <-chan string {
 	return ss.ch
 }
 
-func newStringSub(nd *Node, sub *Sub, path string) *StringSub {
+func newStringSub(vs *ValueSub, path string) *StringSub {
 	ss := &StringSub{
-		nd:   nd,
-		sub:  sub,
+		vs:   vs,
 		path: path,
 		ch:   make(chan string, backlogSize),
 	}
@@ -384,24 +606,13 @@ func newStringSub(nd *Node, sub *Sub, path string) *StringSub {
 
 func (ss *StringSub) run() {
 	defer close(ss.ch)
-	for msg := range ss.sub.C() {
-		// log.Printf("StringSub got msg: %s\n", msg)
-		var m map[string]interface{}
-		if err := json.Unmarshal([]byte(msg), &m); err != nil {
-			log.Printf("Error: invalid json from Sub. That should never happen, but since it did, we just ignore.")
-		}
-		pp := strings.Split(ss.path, ".")
-		val, ok := getIfCan(m, pp)
-		if !ok {
-			// this path is not present in src. Skip.
-			log.Printf("Error: received unnecessary update; wanted path %q was not found in the message", ss.path)
-			continue
-		}
+	for val := range ss.vs.C() {
 		var str string
 		if val != nil {
+			var ok bool
 			str, ok = val.(string)
 			if !ok {
-				log.Printf("Error: received an update where %q is not a string, but %v", val, reflect.TypeOf(val))
+				logger.Error("Received an update where the value is not a string", "path", ss.path, "type", reflect.TypeOf(val))
 				str = ""
 			}
 		}
@@ -410,5 +621,5 @@ func (ss *StringSub) run() {
 }
 
 func (ss *StringSub) Unsub() {
-	ss.nd.Unsub(ss.sub)
+	ss.vs.Unsub()
 }
@@ -1,8 +1,16 @@
 package pubsub
 
 import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/robodone/robosla-common/pkg/logging"
 )
 
 func TestSimple(t *testing.T) {
@@ -16,6 +24,7 @@ func TestSimple(t *testing.T) {
 	if err := node.Pub(`{"world":1}`); err != nil {
 		t.Fatalf("Pub: %v", err)
 	}
+	node.Flush()
 	select {
 	case msg := <-sub.C():
 		t.Errorf("Unexpected update: %v", msg)
@@ -25,6 +34,7 @@ func TestSimple(t *testing.T) {
 	if err := node.Pub(`{"hello":1}`); err != nil {
 		t.Fatalf("Pub2: %v", err)
 	}
+	node.Flush()
 	select {
 	case msg := <-sub.C():
 		want := `{"hello":1}`
@@ -37,6 +47,29 @@ func TestSimple(t *testing.T) {
 	node.Unsub(sub)
 }
 
+func TestPubMap(t *testing.T) {
+	node := NewNode()
+	defer node.Stop()
+
+	sub, err := node.Sub("hello.world")
+	if err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+	if err := node.PubMap(map[string]interface{}{"hello": map[string]interface{}{"world": 1.0}}); err != nil {
+		t.Fatalf("PubMap: %v", err)
+	}
+	node.Flush()
+	select {
+	case msg := <-sub.C():
+		want := `{"hello":{"world":1}}`
+		if msg != want {
+			t.Errorf("Unexpected update message: %q, want: %q", msg, want)
+		}
+	default:
+		t.Errorf("Expected update not received")
+	}
+}
+
 func TestDeep(t *testing.T) {
 	node := NewNode()
 	defer node.Stop()
@@ -48,6 +81,7 @@ func TestDeep(t *testing.T) {
 	if err := node.Pub(`{"world":1}`); err != nil {
 		t.Fatalf("Pub: %v", err)
 	}
+	node.Flush()
 	select {
 	case msg := <-sub.C():
 		t.Errorf("Unexpected update: %v", msg)
@@ -57,6 +91,7 @@ func TestDeep(t *testing.T) {
 	if err := node.Pub(`{"hello":{"world":"lala", "zzz": 3}}`); err != nil {
 		t.Fatalf("Pub2: %v", err)
 	}
+	node.Flush()
 	select {
 	case msg := <-sub.C():
 		want := `{"hello":{"world":"lala"}}`
@@ -131,6 +166,7 @@ func TestUpperLevel(t *testing.T) {
 	if err := node.Pub(`{"world":1}`); err != nil {
 		t.Fatalf("Pub: %v", err)
 	}
+	node.Flush()
 	select {
 	case msg := <-sub.C():
 		t.Errorf("Unexpected update: %v", msg)
@@ -140,6 +176,7 @@ func TestUpperLevel(t *testing.T) {
 	if err := node.Pub(`{"hello":{"world":"lala", "zzz": 3}}`); err != nil {
 		t.Fatalf("Pub2: %v", err)
 	}
+	node.Flush()
 	select {
 	case msg := <-sub.C():
 		want := `{"hello":{"world":"lala","zzz":3}}`
@@ -193,3 +230,188 @@ func TestSeries(t *testing.T) {
 
 	node.Unsub(sub)
 }
+
+// Test that a published update does not modify the objects which were already delivered
+// to the subscribers (the state is copy-on-write).
+func TestCopyOnWrite(t *testing.T) {
+	node := NewNode()
+	defer node.Stop()
+
+	if err := node.Pub(`{"hello":{"world":1}}`); err != nil {
+		t.Fatalf("Pub: %v", err)
+	}
+	node.mu.Lock()
+	before := node.state
+	node.mu.Unlock()
+	if err := node.Pub(`{"hello":{"world":2,"lala":3}}`); err != nil {
+		t.Fatalf("Pub2: %v", err)
+	}
+	if got, want := mustJson(before), `{"hello":{"world":1}}`; got != want {
+		t.Errorf("Old state was modified: %s, want: %s", got, want)
+	}
+	node.mu.Lock()
+	after := node.state
+	node.mu.Unlock()
+	if got, want := mustJson(after), `{"hello":{"lala":3,"world":2}}`; got != want {
+		t.Errorf("Unexpected state: %s, want: %s", got, want)
+	}
+}
+
+func drainSub(sub *Sub, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for range sub.C() {
+	}
+}
+
+// BenchmarkPubManySubscribers publishes from many goroutines into a single node
+// with many subscribers on different paths.
+func BenchmarkPubManySubscribers(b *testing.B) {
+	// Slow subscribers miss updates, don't log every one.
+	logging.SetLevel("pubsub", slog.LevelError)
+	defer logging.SetLevel("pubsub", slog.LevelInfo)
+
+	node := NewNode()
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		sub, err := node.Sub(fmt.Sprintf("printers.p%02d", i%10))
+		if err != nil {
+			b.Fatalf("Sub: %v", err)
+		}
+		wg.Add(1)
+		go drainSub(sub, &wg)
+	}
+	var cnt int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&cnt, 1)
+			update := fmt.Sprintf(`{"printers":{"p%02d":{"frameIndex":%d,"progress":0.5}}}`, i%10, i)
+			if err := node.Pub(update); err != nil {
+				b.Fatalf("Pub: %v", err)
+			}
+		}
+	})
+	node.Flush()
+	b.StopTimer()
+	node.Stop()
+	wg.Wait()
+}
+
+// BenchmarkManagerManyNodes simulates a fleet of printers: each publisher updates its own node,
+// while a universal subscriber and a per-node subscriber receive the updates.
+func BenchmarkManagerManyNodes(b *testing.B) {
+	// Slow subscribers miss updates, don't log every one.
+	logging.SetLevel("pubsub", slog.LevelError)
+	defer logging.SetLevel("pubsub", slog.LevelInfo)
+
+	const numNodes = 300
+	m := NewManager()
+	var wg sync.WaitGroup
+	uni, err := m.SubAll("printers")
+	if err != nil {
+		b.Fatalf("SubAll: %v", err)
+	}
+	wg.Add(1)
+	go drainSub(uni, &wg)
+	for i := 0; i < numNodes; i++ {
+		sub, err := m.Sub(fmt.Sprintf("node%d", i), "printers")
+		if err != nil {
+			b.Fatalf("Sub: %v", err)
+		}
+		wg.Add(1)
+		go drainSub(sub, &wg)
+	}
+	frame := strings.Repeat("A", 4096)
+	var cnt int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := atomic.AddInt64(&cnt, 1)
+			update := fmt.Sprintf(`{"printers":{"p":{"frameIndex":%d,"cameras":{"top":"data:image/jpeg;base64,%s"}}}}`, i, frame)
+			if err := m.Pub(fmt.Sprintf("node%d", i%numNodes), update); err != nil {
+				b.Fatalf("Pub: %v", err)
+			}
+		}
+	})
+	m.Flush()
+	b.StopTimer()
+	m.Stop()
+	wg.Wait()
+}
+
+func TestValue(t *testing.T) {
+	node := NewNode()
+	defer node.Stop()
+
+	vs, err := node.SubValue("hello.world")
+	if err != nil {
+		t.Fatalf("SubValue: %v", err)
+	}
+	if err := node.Pub(`{"hello":{"world":{"a":1},"zzz":3}}`); err != nil {
+		t.Fatalf("Pub: %v", err)
+	}
+	node.Flush()
+	select {
+	case val := <-vs.C():
+		want := map[string]interface{}{"a": float64(1)}
+		if !reflect.DeepEqual(val, want) {
+			t.Errorf("Unexpected value: %v, want: %v", val, want)
+		}
+	default:
+		t.Errorf("Expected update not received")
+	}
+	vs.Unsub()
+	node.Flush()
+	if _, ok := <-vs.C(); ok {
+		t.Errorf("Value sub is not closed after Unsub")
+	}
+}
+
+// BenchmarkPubSharedPaths measures the fan-out to many subscribers with the same paths,
+// which share the marshalled payload.
+func BenchmarkPubSharedPaths(b *testing.B) {
+	// Slow subscribers miss updates, don't log every one.
+	logging.SetLevel("pubsub", slog.LevelError)
+	defer logging.SetLevel("pubsub", slog.LevelInfo)
+
+	node := NewNode()
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		sub, err := node.Sub("printers.p1", "printers.p2")
+		if err != nil {
+			b.Fatalf("Sub: %v", err)
+		}
+		wg.Add(1)
+		go drainSub(sub, &wg)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		update := fmt.Sprintf(`{"printers":{"p1":{"frameIndex":%d,"pose":[1,2,3]}}}`, i)
+		if err := node.Pub(update); err != nil {
+			b.Fatalf("Pub: %v", err)
+		}
+	}
+	node.Flush()
+	b.StopTimer()
+	node.Stop()
+	wg.Wait()
+}
+
+// BenchmarkStringSub measures the delivery of string values to typed subscribers.
+func BenchmarkStringSub(b *testing.B) {
+	node := NewNode()
+	defer node.Stop()
+
+	sub, err := node.SubString("login.cookie")
+	if err != nil {
+		b.Fatalf("SubString: %v", err)
+	}
+	defer sub.Unsub()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := node.Pub(fmt.Sprintf(`{"login":{"cookie":"c%d"}}`, i)); err != nil {
+			b.Fatalf("Pub: %v", err)
+		}
+		<-sub.C()
+	}
+}
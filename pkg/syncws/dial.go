@@ -0,0 +1,141 @@
+package syncws
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Stats are the traffic counters of a socket.
+type Stats struct {
+	// The sizes of the messages, before compression.
+	PayloadRead    int64
+	PayloadWritten int64
+	// The bytes on the wire, including the handshake, framing and TLS. Zero, if the socket
+	// was not created with Dial or Upgrade.
+	WireRead    int64
+	WireWritten int64
+}
+
+// Saved returns the number of bytes saved by compression. It's negative, when the overhead
+// of framing is larger than the savings.
+func (st Stats) Saved() int64 {
+	if st.WireRead == 0 && st.WireWritten == 0 {
+		return 0
+	}
+	return st.PayloadRead + st.PayloadWritten - st.WireRead - st.WireWritten
+}
+
+func (s *Socket) Stats() Stats {
+	st := Stats{
+		PayloadRead:    atomic.LoadInt64(&s.payloadRead),
+		PayloadWritten: atomic.LoadInt64(&s.payloadWritten),
+	}
+	if s.wire != nil {
+		st.WireRead = atomic.LoadInt64(&s.wire.read)
+		st.WireWritten = atomic.LoadInt64(&s.wire.written)
+	}
+	return st
+}
+
+type wireCounter struct {
+	read    int64
+	written int64
+}
+
+// countingConn counts the bytes going through a network connection.
+type countingConn struct {
+	net.Conn
+	wc *wireCounter
+}
+
+func (cc *countingConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	atomic.AddInt64(&cc.wc.read, int64(n))
+	return n, err
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	atomic.AddInt64(&cc.wc.written, int64(n))
+	return n, err
+}
+
+// Dial connects to a websocket server with a copy of d, negotiating compression, if it's enabled in opts.
+// The connections made by d.NetDialContext or d.NetDial are counted in Stats.
+func Dial(d *websocket.Dialer, url string, header http.Header, opts Options) (*Socket, *http.Response, error) {
+	wc := new(wireCounter)
+	dialer := *d
+	dialer.EnableCompression = opts.Compression
+	count := func(conn net.Conn, err error) (net.Conn, error) {
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, wc: wc}, nil
+	}
+	// The dialer prefers NetDialContext, so only the one it would use is wrapped.
+	switch {
+	case d.NetDialContext != nil:
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return count(d.NetDialContext(ctx, network, addr))
+		}
+	case d.NetDial != nil:
+		dialer.NetDial = func(network, addr string) (net.Conn, error) {
+			return count(d.NetDial(network, addr))
+		}
+	default:
+		dialer.NetDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return count((&net.Dialer{}).DialContext(ctx, network, addr))
+		}
+	}
+	conn, resp, err := dialer.Dial(url, header)
+	if err != nil {
+		return nil, resp, err
+	}
+	s := NewSocketWithOptions(conn, opts)
+	s.wire = wc
+	return s, resp, nil
+}
+
+// countingHijacker makes the upgrader use a counting connection.
+type countingHijacker struct {
+	http.ResponseWriter
+	wc *wireCounter
+}
+
+func (ch *countingHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := ch.ResponseWriter.(http.Hijacker).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, wc: ch.wc}, brw, nil
+}
+
+// Upgrade upgrades a server HTTP connection to a websocket, negotiating compression, if it's enabled in opts.
+// u may be nil.
+func Upgrade(u *websocket.Upgrader, w http.ResponseWriter, r *http.Request, opts Options) (*Socket, error) {
+	upgrader := websocket.Upgrader{}
+	if u != nil {
+		upgrader = *u
+	}
+	upgrader.EnableCompression = opts.Compression
+	if upgrader.ReadBufferSize == 0 {
+		// Otherwise, the upgrader reuses the reader of the HTTP server, which bypasses the counting.
+		upgrader.ReadBufferSize = 4096
+	}
+	wc := new(wireCounter)
+	if _, ok := w.(http.Hijacker); ok {
+		w = &countingHijacker{ResponseWriter: w, wc: wc}
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSocketWithOptions(conn, opts)
+	s.wire = wc
+	return s, nil
+}
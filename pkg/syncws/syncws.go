@@ -1,43 +1,218 @@
+// Package syncws wraps gorilla websockets for concurrent use: reads and writes are serialized
+// separately. Sockets created by NewSocket behave like plain websockets. Dial, Upgrade and
+// NewSocketWithOptions(conn, DefaultOptions) also keep the connection alive with pings, and detect
+// dead connections with read and write deadlines.
+//
+// DefaultOptions also enable compression of text messages and limit incoming messages to 32 MiB,
+// so an old peer, which sends larger messages, is disconnected. Pass Options with ReadLimit set
+// to zero to remove the limit.
 package syncws
 
 import (
-	"log"
+	"encoding/binary"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/robodone/robosla-common/pkg/logging"
 )
 
+// ErrConnectionDead is returned by ReadMessage, if the other side stopped answering pings.
+var ErrConnectionDead = errors.New("connection is dead: no messages or pongs received in time")
+
+var logger = logging.For("syncws")
+
+// Options configure the keepalive of a socket.
+type Options struct {
+	// How often to send pings. Zero disables pings and read deadlines.
+	PingInterval time.Duration
+	// The connection is considered dead, if nothing (including pongs) is received for this long.
+	// 2*PingInterval, if zero.
+	PongTimeout time.Duration
+	// The deadline for writing a message. PingInterval, if zero.
+	WriteTimeout time.Duration
+	// The maximum size of an incoming message. Zero means no limit.
+	ReadLimit int64
+	// Negotiate permessage-deflate in Dial and Upgrade. Only text messages are compressed,
+	// as binary ones (like JPEG frames) are already compressed.
+	Compression bool
+	// See compress/flate. The default level, if zero.
+	CompressionLevel int
+}
+
+var DefaultOptions = Options{
+	PingInterval: 30 * time.Second,
+	PongTimeout:  75 * time.Second,
+	WriteTimeout: 15 * time.Second,
+	ReadLimit:    32 << 20,
+	Compression:  true,
+}
+
+func (o Options) pongTimeout() time.Duration {
+	if o.PongTimeout == 0 {
+		return 2 * o.PingInterval
+	}
+	return o.PongTimeout
+}
+
+func (o Options) writeTimeout() time.Duration {
+	if o.WriteTimeout == 0 {
+		return o.PingInterval
+	}
+	return o.WriteTimeout
+}
+
 type Socket struct {
 	wmu  sync.Mutex
 	rmu  sync.Mutex
 	conn *websocket.Conn
+	opts Options
+
+	// Pings carry the time they were sent, relative to start.
+	start time.Time
+	mu    sync.Mutex
+	rtt   time.Duration
+	dead  bool
+	// Closed by Close to stop pinging.
+	closed    chan bool
+	closeOnce sync.Once
+
+	// Set, if the socket was created by Dial or Upgrade.
+	wire           *wireCounter
+	payloadRead    int64
+	payloadWritten int64
 }
 
+// NewSocket wraps conn without pings, deadlines and limits.
+// Use NewSocketWithOptions with DefaultOptions to enable them.
 func NewSocket(conn *websocket.Conn) *Socket {
-	return &Socket{conn: conn}
+	return NewSocketWithOptions(conn, Options{})
+}
+
+func NewSocketWithOptions(conn *websocket.Conn, opts Options) *Socket {
+	s := &Socket{
+		conn:   conn,
+		opts:   opts,
+		start:  time.Now(),
+		closed: make(chan bool),
+	}
+	if opts.ReadLimit > 0 {
+		conn.SetReadLimit(opts.ReadLimit)
+	}
+	if opts.Compression && opts.CompressionLevel != 0 {
+		if err := conn.SetCompressionLevel(opts.CompressionLevel); err != nil {
+			logger.Warn("Invalid compression level", "level", opts.CompressionLevel, "err", err)
+		}
+	}
+	if opts.PingInterval > 0 {
+		s.extendReadDeadline()
+		conn.SetPongHandler(s.handlePong)
+		go s.pingLoop()
+	}
+	return s
+}
+
+func (s *Socket) extendReadDeadline() {
+	if s.opts.PingInterval > 0 {
+		s.conn.SetReadDeadline(time.Now().Add(s.opts.pongTimeout()))
+	}
+}
+
+func (s *Socket) handlePong(appData string) error {
+	s.extendReadDeadline()
+	if len(appData) != 8 {
+		return nil
+	}
+	sent := time.Duration(binary.BigEndian.Uint64([]byte(appData)))
+	s.mu.Lock()
+	s.rtt = time.Since(s.start) - sent
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Socket) pingLoop() {
+	ticker := time.NewTicker(s.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+		var payload [8]byte
+		binary.BigEndian.PutUint64(payload[:], uint64(time.Since(s.start)))
+		err := s.conn.WriteControl(websocket.PingMessage, payload[:], time.Now().Add(s.opts.writeTimeout()))
+		if err != nil {
+			logger.Warn("Failed to send a ping. Closing the connection", "err", err)
+			s.markDead()
+			s.Close()
+			return
+		}
+	}
+}
+
+func (s *Socket) markDead() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dead = true
+}
+
+// RTT returns the round-trip time measured with the last ping, or zero if no pong was received yet.
+func (s *Socket) RTT() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rtt
 }
 
 func (s *Socket) WriteMessage(data []byte) error {
+	return s.writeMessage(websocket.TextMessage, data)
+}
+
+func (s *Socket) WriteBinaryMessage(data []byte) error {
+	return s.writeMessage(websocket.BinaryMessage, data)
+}
+
+func (s *Socket) writeMessage(messageType int, data []byte) error {
 	s.wmu.Lock()
 	defer s.wmu.Unlock()
-	err := s.conn.WriteMessage(websocket.TextMessage, data)
+	if timeout := s.opts.writeTimeout(); timeout > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	// It's a no-op, unless compression was negotiated.
+	s.conn.EnableWriteCompression(s.opts.Compression && messageType == websocket.TextMessage)
+	err := s.conn.WriteMessage(messageType, data)
 	if err != nil {
-		log.Printf("Failed to write to a websocket: %v", err)
+		logger.Warn("Failed to write to a websocket", "err", err)
+		return err
 	}
-	return err
+	atomic.AddInt64(&s.payloadWritten, int64(len(data)))
+	return nil
 }
 
+// ReadMessage returns the next text or binary message. If the other side stopped
+// responding to pings, ErrConnectionDead is returned.
 func (s *Socket) ReadMessage() (messageType int, p []byte, err error) {
 	s.rmu.Lock()
 	defer s.rmu.Unlock()
 	for {
 		messageType, p, err = s.conn.ReadMessage()
 		if err != nil {
+			s.mu.Lock()
+			dead := s.dead
+			s.mu.Unlock()
+			if ne, ok := err.(net.Error); dead || ok && ne.Timeout() {
+				logger.Warn("Connection is dead", "err", err)
+				return 0, nil, ErrConnectionDead
+			}
 			return 0, nil, err
 		}
+		s.extendReadDeadline()
+		atomic.AddInt64(&s.payloadRead, int64(len(p)))
 		if messageType != websocket.TextMessage && messageType != websocket.BinaryMessage {
-			log.Printf("messageType: %d, ignoring...\n", messageType)
+			logger.Debug("Unexpected message type, ignoring...", "type", messageType)
 			continue
 		}
 		return messageType, p, nil
@@ -45,6 +220,7 @@ func (s *Socket) ReadMessage() (messageType int, p []byte, err error) {
 }
 
 func (s *Socket) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
 	return s.conn.Close()
 }
 
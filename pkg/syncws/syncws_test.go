@@ -0,0 +1,160 @@
+package syncws
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startServer starts a websocket server, which reads messages until the connection is closed.
+// If answerPings is false, pings are silently ignored, like on a half-open connection.
+func startServer(t *testing.T, answerPings bool) (*httptest.Server, string) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if !answerPings {
+			conn.SetPingHandler(func(string) error { return nil })
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	return ts, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+func dial(t *testing.T, url string, opts Options) *Socket {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return NewSocketWithOptions(conn, opts)
+}
+
+func TestKeepaliveRTT(t *testing.T) {
+	ts, url := startServer(t, true)
+	defer ts.Close()
+	s := dial(t, url, Options{PingInterval: 10 * time.Millisecond})
+	defer s.Close()
+
+	// Pongs are processed by ReadMessage, so it must be running.
+	go s.ReadMessage()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("RTT was not measured")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeepaliveDeadConnection(t *testing.T) {
+	ts, url := startServer(t, false)
+	defer ts.Close()
+	s := dial(t, url, Options{PingInterval: 10 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+	defer s.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := s.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrConnectionDead {
+			t.Errorf("ReadMessage: %v, want: %v", err, ErrConnectionDead)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dead connection was not detected")
+	}
+}
+
+func TestCompressionAndReadLimit(t *testing.T) {
+	opts := Options{Compression: true, ReadLimit: 1 << 16}
+	received := make(chan error, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := Upgrade(nil, w, r, opts)
+		if err != nil {
+			received <- err
+			return
+		}
+		defer s.Close()
+		for {
+			_, _, err := s.ReadMessage()
+			received <- err
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer ts.Close()
+
+	s, _, err := Dial(websocket.DefaultDialer, "ws"+strings.TrimPrefix(ts.URL, "http"), nil, opts)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer s.Close()
+	msg := []byte(strings.Repeat(`{"type":"progress","progress":0.5}`, 1000))
+	if err := s.WriteMessage(msg); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if err := <-received; err != nil {
+		t.Fatalf("Server failed to read a compressed message: %v", err)
+	}
+	st := s.Stats()
+	if st.PayloadWritten != int64(len(msg)) || st.Saved() <= int64(len(msg))/2 {
+		t.Errorf("Unexpected stats: %+v, saved: %d", st, st.Saved())
+	}
+
+	// Binary messages are not compressed, and this one is over the limit.
+	s.WriteBinaryMessage(make([]byte, 2*opts.ReadLimit))
+	select {
+	case err := <-received:
+		if err != websocket.ErrReadLimit {
+			t.Errorf("Server read a message over the limit: %v, want: %v", err, websocket.ErrReadLimit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out")
+	}
+}
+
+func TestDialCustomNetDial(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := Upgrade(nil, w, r, Options{})
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.ReadMessage()
+	}))
+	defer ts.Close()
+
+	var dialed int32
+	d := *websocket.DefaultDialer
+	d.NetDial = func(network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return net.Dial(network, addr)
+	}
+	s, _, err := Dial(&d, "ws"+strings.TrimPrefix(ts.URL, "http"), nil, Options{})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer s.Close()
+	if atomic.LoadInt32(&dialed) != 1 {
+		t.Errorf("NetDial was called %d times, want: 1", dialed)
+	}
+	if st := s.Stats(); st.WireWritten == 0 {
+		t.Errorf("The handshake is not counted: %+v", st)
+	}
+}
@@ -0,0 +1,203 @@
+// Package terminal keeps the recent terminal output of devices in bounded ring buffers,
+// so that late subscribers can fetch the last lines and then follow the stream.
+package terminal
+
+import "sync"
+
+const (
+	DefaultCapacity = 1000
+
+	// The size of the channel of a follower. If it's full, the follower is dropped.
+	followerBacklogSize = 100
+)
+
+// Line is a single line of terminal output. Sequence numbers are assigned by the producer
+// and are increasing; a gap means that the lines were dropped on the way.
+type Line struct {
+	Seq int64 `json:"seq"`
+	// Milliseconds since the Unix epoch.
+	TS   int64  `json:"ts"`
+	Text string `json:"text"`
+}
+
+// Buffer is a bounded ring buffer of lines. It's safe for concurrent use.
+type Buffer struct {
+	mu        sync.Mutex
+	lines     []Line
+	start     int
+	n         int
+	lastSeq   int64
+	followers map[*Follower]bool
+}
+
+func NewBuffer(capacity int) *Buffer {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &Buffer{
+		lines:     make([]Line, capacity),
+		followers: make(map[*Follower]bool),
+	}
+}
+
+// Append adds a line with the next sequence number and returns it.
+func (b *Buffer) Append(ts int64, text string) Line {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	line := Line{Seq: b.lastSeq + 1, TS: ts, Text: text}
+	b.addLocked(line)
+	return line
+}
+
+// Add adds lines with sequence numbers assigned by the producer. Lines which are not newer
+// than the last added line are duplicates (for example, resent after a reconnect) and are skipped.
+// It returns the number of added lines.
+func (b *Buffer) Add(lines ...Line) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cnt := 0
+	for _, line := range lines {
+		if line.Seq <= b.lastSeq {
+			continue
+		}
+		b.addLocked(line)
+		cnt++
+	}
+	return cnt
+}
+
+func (b *Buffer) addLocked(line Line) {
+	idx := (b.start + b.n) % len(b.lines)
+	if b.n == len(b.lines) {
+		// Overwrite the oldest line.
+		b.start = (b.start + 1) % len(b.lines)
+	} else {
+		b.n++
+	}
+	b.lines[idx] = line
+	b.lastSeq = line.Seq
+	for f := range b.followers {
+		select {
+		case f.ch <- line:
+		default:
+			// The follower can't keep up. Drop it, so it can catch up using Since.
+			f.lagged = true
+			b.removeLocked(f)
+		}
+	}
+}
+
+// LastSeq returns the sequence number of the last added line, or 0 if there were no lines.
+func (b *Buffer) LastSeq() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastSeq
+}
+
+// Tail returns up to n last lines.
+func (b *Buffer) Tail(n int) []Line {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tailLocked(n)
+}
+
+func (b *Buffer) tailLocked(n int) []Line {
+	if n > b.n {
+		n = b.n
+	}
+	if n < 0 {
+		n = 0
+	}
+	res := make([]Line, 0, n)
+	for i := b.n - n; i < b.n; i++ {
+		res = append(res, b.lines[(b.start+i)%len(b.lines)])
+	}
+	return res
+}
+
+// Since returns the lines with sequence numbers greater than seq which are still in the buffer.
+func (b *Buffer) Since(seq int64) []Line {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	i := 0
+	for ; i < b.n; i++ {
+		if b.lines[(b.start+i)%len(b.lines)].Seq > seq {
+			break
+		}
+	}
+	return b.tailLocked(b.n - i)
+}
+
+// Follow returns a follower which first receives up to n last lines, and then the new lines as they come.
+func (b *Buffer) Follow(n int) *Follower {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tail := b.tailLocked(n)
+	backlog := followerBacklogSize
+	if len(tail) > backlog {
+		backlog = len(tail)
+	}
+	f := &Follower{b: b, ch: make(chan Line, backlog)}
+	for _, line := range tail {
+		f.ch <- line
+	}
+	b.followers[f] = true
+	return f
+}
+
+func (b *Buffer) removeLocked(f *Follower) {
+	if !b.followers[f] {
+		return
+	}
+	delete(b.followers, f)
+	close(f.ch)
+}
+
+// Follower receives the lines added to a buffer.
+type Follower struct {
+	b      *Buffer
+	ch     chan Line
+	lagged bool
+}
+
+// C returns the channel with lines. It's closed when the follower is stopped, or when it falls behind.
+func (f *Follower) C() <-chan Line {
+	return f.ch
+}
+
+// Lagged reports whether the follower was dropped because it could not keep up.
+// It's only meaningful after the channel is closed.
+func (f *Follower) Lagged() bool {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	return f.lagged
+}
+
+func (f *Follower) Stop() {
+	f.b.mu.Lock()
+	defer f.b.mu.Unlock()
+	f.b.removeLocked(f)
+}
+
+// Streams keeps a buffer per device.
+type Streams struct {
+	mu       sync.Mutex
+	capacity int
+	bufs     map[string]*Buffer
+}
+
+func NewStreams(capacity int) *Streams {
+	return &Streams{capacity: capacity, bufs: make(map[string]*Buffer)}
+}
+
+// Get returns the buffer of the device, creating it if needed.
+func (s *Streams) Get(deviceName string) *Buffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.bufs[deviceName]
+	if !ok {
+		b = NewBuffer(s.capacity)
+		s.bufs[deviceName] = b
+	}
+	return b
+}
@@ -0,0 +1,72 @@
+package terminal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func texts(lines []Line) []string {
+	var res []string
+	for _, line := range lines {
+		res = append(res, line.Text)
+	}
+	return res
+}
+
+func TestBuffer(t *testing.T) {
+	b := NewBuffer(3)
+	for _, text := range []string{"a", "b", "c", "d"} {
+		b.Append(0, text)
+	}
+	if got, want := texts(b.Tail(10)), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tail(10): %q, want: %q", got, want)
+	}
+	if got, want := texts(b.Tail(2)), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Tail(2): %q, want: %q", got, want)
+	}
+	if got, want := texts(b.Since(2)), []string{"c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Since(2): %q, want: %q", got, want)
+	}
+	if got := b.Since(4); len(got) != 0 {
+		t.Errorf("Since(4): %v, want nothing", got)
+	}
+	// Duplicates (resent lines) are skipped, gaps are preserved.
+	if n := b.Add(Line{Seq: 4, Text: "d"}, Line{Seq: 7, Text: "g"}); n != 1 {
+		t.Errorf("Add: %d lines added, want: 1", n)
+	}
+	if got := b.LastSeq(); got != 7 {
+		t.Errorf("LastSeq: %d, want: 7", got)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	b := NewBuffer(10)
+	b.Append(0, "a")
+	b.Append(0, "b")
+	f := b.Follow(1)
+	b.Append(0, "c")
+	f.Stop()
+
+	var got []Line
+	for line := range f.C() {
+		got = append(got, line)
+	}
+	if want := []string{"b", "c"}; !reflect.DeepEqual(texts(got), want) {
+		t.Errorf("Follow: %q, want: %q", texts(got), want)
+	}
+	if f.Lagged() {
+		t.Errorf("Follower is unexpectedly lagged")
+	}
+
+	slow := b.Follow(0)
+	for i := 0; i < followerBacklogSize+1; i++ {
+		b.Append(0, "x")
+	}
+	cnt := 0
+	for range slow.C() {
+		cnt++
+	}
+	if cnt != followerBacklogSize || !slow.Lagged() {
+		t.Errorf("Slow follower: received %d lines, lagged: %v; want: %d lines, lagged", cnt, slow.Lagged(), followerBacklogSize)
+	}
+}
@@ -0,0 +1,174 @@
+package timelapse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	avifHasIndex   = 0x10
+	aviifKeyframe  = 0x10
+	aviMainHdrSize = 56
+	aviStrHdrSize  = 56
+	bitmapInfoSize = 40
+)
+
+type aviIndexEntry struct {
+	offset uint32
+	size   uint32
+}
+
+// aviWriter writes a Motion JPEG AVI file. The sizes which are not known in advance
+// are patched in Close, so the destination must be seekable.
+type aviWriter struct {
+	w      io.WriteSeeker
+	fps    int
+	width  int
+	height int
+
+	pos      int64
+	moviPos  int64
+	maxFrame uint32
+	index    []aviIndexEntry
+	err      error
+}
+
+// Positions of the fields that are patched in Close.
+const (
+	riffSizePos        = 4
+	avihTotalFramesPos = 12 + 8 + 12 + 16
+	avihBufferSizePos  = avihTotalFramesPos + 12
+	strhLengthPos      = 12 + 8 + 12 + aviMainHdrSize + 8 + 12 + 32
+	strhBufferSizePos  = strhLengthPos + 4
+	moviSizePos        = 12 + 8 + 4 + 8 + aviMainHdrSize + 12 + 8 + aviStrHdrSize + 8 + bitmapInfoSize + 4
+)
+
+func newAVIWriter(w io.WriteSeeker, fps, width, height int) (*aviWriter, error) {
+	if fps <= 0 {
+		return nil, fmt.Errorf("invalid fps: %d", fps)
+	}
+	aw := &aviWriter{w: w, fps: fps, width: width, height: height}
+	aw.writeHeader()
+	return aw, aw.err
+}
+
+func (aw *aviWriter) write(data ...interface{}) {
+	if aw.err != nil {
+		return
+	}
+	for _, v := range data {
+		var buf bytes.Buffer
+		switch v := v.(type) {
+		case string:
+			buf.WriteString(v)
+		case []byte:
+			buf.Write(v)
+		default:
+			binary.Write(&buf, binary.LittleEndian, v)
+		}
+		n, err := aw.w.Write(buf.Bytes())
+		aw.pos += int64(n)
+		if err != nil {
+			aw.err = err
+			return
+		}
+	}
+}
+
+func (aw *aviWriter) writeHeader() {
+	hdrlSize := uint32(4 + 8 + aviMainHdrSize + 12 + 8 + aviStrHdrSize + 8 + bitmapInfoSize)
+	strlSize := uint32(4 + 8 + aviStrHdrSize + 8 + bitmapInfoSize)
+	w, h := uint32(aw.width), uint32(aw.height)
+
+	aw.write("RIFF", uint32(0), "AVI ")
+	aw.write("LIST", hdrlSize, "hdrl")
+	aw.write("avih", uint32(aviMainHdrSize),
+		uint32(1000000/aw.fps), // MicroSecPerFrame
+		uint32(0),              // MaxBytesPerSec
+		uint32(0),              // PaddingGranularity
+		uint32(avifHasIndex),   // Flags
+		uint32(0),              // TotalFrames, patched in Close
+		uint32(0),              // InitialFrames
+		uint32(1),              // Streams
+		uint32(0),              // SuggestedBufferSize, patched in Close
+		w, h,
+		[4]uint32{})
+	aw.write("LIST", strlSize, "strl")
+	aw.write("strh", uint32(aviStrHdrSize),
+		"vids", "MJPG",
+		uint32(0),      // Flags
+		uint16(0),      // Priority
+		uint16(0),      // Language
+		uint32(0),      // InitialFrames
+		uint32(1),      // Scale
+		uint32(aw.fps), // Rate
+		uint32(0),      // Start
+		uint32(0),      // Length, patched in Close
+		uint32(0),      // SuggestedBufferSize, patched in Close
+		int32(-1),      // Quality
+		uint32(0),      // SampleSize
+		[4]uint16{0, 0, uint16(w), uint16(h)})
+	aw.write("strf", uint32(bitmapInfoSize),
+		uint32(bitmapInfoSize),
+		int32(w), int32(h),
+		uint16(1),  // Planes
+		uint16(24), // BitCount
+		"MJPG",
+		w*h*3, // SizeImage
+		int32(0), int32(0),
+		uint32(0), uint32(0))
+	aw.write("LIST", uint32(0), "movi")
+	aw.moviPos = aw.pos - 4
+}
+
+func (aw *aviWriter) WriteFrame(data []byte) error {
+	offset := uint32(aw.pos - aw.moviPos)
+	aw.write("00dc", uint32(len(data)), data)
+	if len(data)%2 == 1 {
+		// Chunks are word-aligned.
+		aw.write([]byte{0})
+	}
+	aw.index = append(aw.index, aviIndexEntry{offset: offset, size: uint32(len(data))})
+	if uint32(len(data)) > aw.maxFrame {
+		aw.maxFrame = uint32(len(data))
+	}
+	return aw.err
+}
+
+func (aw *aviWriter) patch(pos int64, val uint32) {
+	if aw.err != nil {
+		return
+	}
+	if _, err := aw.w.Seek(pos, io.SeekStart); err != nil {
+		aw.err = err
+		return
+	}
+	aw.err = binary.Write(aw.w, binary.LittleEndian, val)
+}
+
+// Close writes the index and patches the headers. It does not close the underlying writer.
+func (aw *aviWriter) Close() error {
+	if len(aw.index) == 0 {
+		return errors.New("no frames written")
+	}
+	moviSize := uint32(aw.pos - aw.moviPos)
+	aw.write("idx1", uint32(16*len(aw.index)))
+	for _, e := range aw.index {
+		aw.write("00dc", uint32(aviifKeyframe), e.offset, e.size)
+	}
+	end := aw.pos
+	numFrames := uint32(len(aw.index))
+	aw.patch(riffSizePos, uint32(end-8))
+	aw.patch(avihTotalFramesPos, numFrames)
+	aw.patch(avihBufferSizePos, aw.maxFrame)
+	aw.patch(strhLengthPos, numFrames)
+	aw.patch(strhBufferSizePos, aw.maxFrame)
+	aw.patch(moviSizePos, moviSize)
+	if aw.err == nil {
+		_, aw.err = aw.w.Seek(end, io.SeekStart)
+	}
+	return aw.err
+}
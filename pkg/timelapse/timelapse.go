@@ -0,0 +1,253 @@
+// Package timelapse assembles per-layer camera frames of a print job into a time-lapse video.
+package timelapse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/logging"
+)
+
+const (
+	DefaultFPS = 10
+
+	jpegContentType = "image/jpeg"
+	jpegDataURLPref = "data:image/jpeg;base64,"
+)
+
+var ErrRecorderFinished = errors.New("recorder is already finished")
+
+var logger = logging.For("timelapse")
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Publisher is the part of pubsub.Manager used to publish the video URL.
+type Publisher interface {
+	Pub(nodeName, jsonStr string) error
+}
+
+type Config struct {
+	// Local directory where frames and videos are saved.
+	Dir string
+	// URL prefix under which Dir is served. The video URL is BaseURL + "/" + file name.
+	BaseURL string
+	// Camera to record. If empty, frames from any camera are recorded.
+	Camera string
+	// Frames per second of the resulting video. DefaultFPS, if not set.
+	FPS int
+}
+
+// Recorder collects the latest camera frame for every layer (UplinkMessage.FrameIndex) of a job.
+// When the job is finished, it assembles the frames into a Motion JPEG AVI file and publishes
+// its URL as printers.<deviceName>.videoURL into the specified pubsub node.
+type Recorder struct {
+	cfg        Config
+	pub        Publisher
+	nodeName   string
+	deviceName string
+	jobName    string
+	// The common part of the names of the frames directory and the video file.
+	baseName  string
+	framesDir string
+
+	mu         sync.Mutex
+	frameIndex int
+	finished   bool
+}
+
+func NewRecorder(cfg Config, pub Publisher, nodeName, deviceName, jobName string) (*Recorder, error) {
+	if cfg.FPS == 0 {
+		cfg.FPS = DefaultFPS
+	}
+	r := &Recorder{
+		cfg:        cfg,
+		pub:        pub,
+		nodeName:   nodeName,
+		deviceName: deviceName,
+		jobName:    jobName,
+		baseName:   uniqueName(deviceName, jobName, time.Now()),
+	}
+	r.framesDir = filepath.Join(cfg.Dir, r.baseName+".frames")
+	if err := os.MkdirAll(r.framesDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create a directory for frames: %v", err)
+	}
+	return r, nil
+}
+
+// safeName makes a string safe to be used as a part of a file name.
+func safeName(s string) string {
+	s = unsafeFileChars.ReplaceAllString(s, "_")
+	if s == "" {
+		return "_"
+	}
+	return s
+}
+
+// uniqueName returns a file name for a recording of the job of the device, started at start.
+// safeName maps different names to the same string, and the same job might be printed again,
+// so a random suffix is appended.
+func uniqueName(deviceName, jobName string, start time.Time) string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		binary.BigEndian.PutUint32(b[:], uint32(start.UnixNano()))
+	}
+	return safeName(deviceName) + "-" + safeName(jobName) + "-" + start.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(b[:])
+}
+
+// Observe tracks the current frame index of the job. If the message carries legacy data URL
+// camera frames, they are recorded as well.
+func (r *Recorder) Observe(msg *device_api.UplinkMessage) error {
+	if msg.JobName != "" && msg.JobName != r.jobName {
+		// An update for some other job.
+		return nil
+	}
+	r.mu.Lock()
+	r.frameIndex = msg.FrameIndex
+	r.mu.Unlock()
+
+	for camera, dataURL := range msg.Cameras {
+		if r.cfg.Camera != "" && camera != r.cfg.Camera {
+			continue
+		}
+		if !strings.HasPrefix(dataURL, jpegDataURLPref) {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(dataURL[len(jpegDataURLPref):])
+		if err != nil {
+			return fmt.Errorf("failed to decode a data URL from camera %q: %v", camera, err)
+		}
+		if err := r.AddFrameAt(msg.FrameIndex, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddFrame records the camera frame for the current frame index.
+func (r *Recorder) AddFrame(frame *device_api.CameraFrame) error {
+	if r.cfg.Camera != "" && frame.Camera != r.cfg.Camera {
+		return nil
+	}
+	if frame.ContentType != jpegContentType {
+		return fmt.Errorf("unsupported content type %q, only %s is supported", frame.ContentType, jpegContentType)
+	}
+	r.mu.Lock()
+	frameIndex := r.frameIndex
+	r.mu.Unlock()
+	return r.AddFrameAt(frameIndex, frame.Data)
+}
+
+// AddFrameAt records a JPEG frame for the specified frame index, replacing the previous one.
+func (r *Recorder) AddFrameAt(frameIndex int, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished {
+		return ErrRecorderFinished
+	}
+	if frameIndex < 0 {
+		return fmt.Errorf("invalid frame index: %d", frameIndex)
+	}
+	name := filepath.Join(r.framesDir, fmt.Sprintf("%08d.jpg", frameIndex))
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to save a frame: %v", err)
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Finish assembles the recorded frames into a video, publishes its URL and removes the frames.
+func (r *Recorder) Finish() (videoURL string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished {
+		return "", ErrRecorderFinished
+	}
+
+	names, err := filepath.Glob(filepath.Join(r.framesDir, "*.jpg"))
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		r.finished = true
+		if err := os.RemoveAll(r.framesDir); err != nil {
+			logger.Warn("Failed to remove time-lapse frames", "dir", r.framesDir, "err", err)
+		}
+		return "", errors.New("no frames were recorded")
+	}
+	sort.Strings(names)
+
+	// On failure, the partial video is removed and the frames are kept, so Finish can be retried.
+	videoName := r.baseName + ".avi"
+	videoPath := filepath.Join(r.cfg.Dir, videoName)
+	f, err := os.Create(videoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to create a video file: %v", err)
+	}
+	err = r.writeVideo(f, names)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(videoPath)
+		return "", fmt.Errorf("failed to write a video: %v", err)
+	}
+	r.finished = true
+	if err := os.RemoveAll(r.framesDir); err != nil {
+		logger.Warn("Failed to remove time-lapse frames", "dir", r.framesDir, "err", err)
+	}
+
+	videoURL = strings.TrimSuffix(r.cfg.BaseURL, "/") + "/" + videoName
+	update := map[string]interface{}{
+		"printers": map[string]interface{}{
+			r.deviceName: map[string]interface{}{"videoURL": videoURL},
+		},
+	}
+	data, err := json.Marshal(update)
+	if err != nil {
+		return "", err
+	}
+	if err := r.pub.Pub(r.nodeName, string(data)); err != nil {
+		return "", fmt.Errorf("failed to publish the video URL: %v", err)
+	}
+	return videoURL, nil
+}
+
+// writeVideo writes the frames from the files one by one, so that only a single frame
+// is kept in memory.
+func (r *Recorder) writeVideo(f *os.File, names []string) error {
+	var aw *aviWriter
+	for i, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return fmt.Errorf("failed to read a frame: %v", err)
+		}
+		if aw == nil {
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				return fmt.Errorf("failed to decode the first frame: %v", err)
+			}
+			if aw, err = newAVIWriter(f, r.cfg.FPS, cfg.Width, cfg.Height); err != nil {
+				return err
+			}
+		}
+		if err := aw.WriteFrame(data); err != nil {
+			return fmt.Errorf("failed to write frame #%d: %v", i, err)
+		}
+	}
+	return aw.Close()
+}
@@ -0,0 +1,179 @@
+package timelapse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+func testJPEG(t *testing.T, shade uint8) []byte {
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	for i := range img.Pix {
+		img.Pix[i] = shade
+	}
+	img.Set(0, 0, color.Gray{255 - shade})
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatalf("jpeg.Encode: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timelapse")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := pubsub.NewManager()
+	defer m.Stop()
+	sub, err := m.Sub("user@example.com", "printers.w01.videoURL")
+	if err != nil {
+		t.Fatalf("Sub: %v", err)
+	}
+
+	cfg := Config{Dir: dir, BaseURL: "https://example.com/videos/", Camera: "top"}
+	r, err := NewRecorder(cfg, m, "user@example.com", "w01", "job 1")
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := r.Observe(&device_api.UplinkMessage{JobName: "job 1", FrameIndex: i}); err != nil {
+			t.Fatalf("Observe: %v", err)
+		}
+		for _, camera := range []string{"top", "side"} {
+			frame := &device_api.CameraFrame{
+				Camera:      camera,
+				TS:          time.Now(),
+				ContentType: "image/jpeg",
+				Data:        testJPEG(t, uint8(i*10)),
+			}
+			if err := r.AddFrame(frame); err != nil {
+				t.Fatalf("AddFrame: %v", err)
+			}
+		}
+	}
+	videoURL, err := r.Finish()
+	if err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	videoName := r.baseName + ".avi"
+	if want := "https://example.com/videos/" + videoName; videoURL != want {
+		t.Errorf("Unexpected video URL: %s, want: %s", videoURL, want)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, videoName))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data[:4]) != "RIFF" || string(data[8:12]) != "AVI " {
+		t.Errorf("Not an AVI file: %q", data[:12])
+	}
+	if got, want := binary.LittleEndian.Uint32(data[4:8]), uint32(len(data)-8); got != want {
+		t.Errorf("Wrong RIFF size: %d, want: %d", got, want)
+	}
+	if got := binary.LittleEndian.Uint32(data[avihTotalFramesPos:]); got != 3 {
+		t.Errorf("Wrong number of frames: %d, want: 3", got)
+	}
+	if got := bytes.Count(data, []byte("00dc")); got != 6 {
+		// 3 frames plus 3 index entries.
+		t.Errorf("Unexpected number of frame chunks and index entries: %d, want: 6", got)
+	}
+	if _, err := os.Stat(r.framesDir); !os.IsNotExist(err) {
+		t.Errorf("Frames directory was not removed: %v", err)
+	}
+
+	m.Flush()
+	select {
+	case msg := <-sub.C():
+		want := `{"printers":{"w01":{"videoURL":"https://example.com/videos/` + videoName + `"}}}`
+		if msg != want {
+			t.Errorf("Unexpected update: %s, want: %s", msg, want)
+		}
+	default:
+		t.Errorf("Video URL was not published")
+	}
+}
+
+func TestRecorderNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timelapse")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := pubsub.NewManager()
+	defer m.Stop()
+	r1, err := NewRecorder(Config{Dir: dir}, m, "user@example.com", "w01", "job 1")
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	r2, err := NewRecorder(Config{Dir: dir}, m, "user@example.com", "w01", "job_1")
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	if r1.baseName == r2.baseName {
+		t.Errorf("Different jobs got the same file name: %s", r1.baseName)
+	}
+	// The same job is printed again.
+	r3, err := NewRecorder(Config{Dir: dir}, m, "user@example.com", "w01", "job 1")
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	if r1.baseName == r3.baseName {
+		t.Errorf("Two recordings of the same job got the same file name: %s", r1.baseName)
+	}
+
+	if _, err := r1.Finish(); err == nil {
+		t.Errorf("Finish without frames succeeded")
+	}
+	if _, err := os.Stat(r1.framesDir); !os.IsNotExist(err) {
+		t.Errorf("Frames directory was not removed: %v", err)
+	}
+}
+
+func TestRecorderFinishRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "timelapse")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := pubsub.NewManager()
+	defer m.Stop()
+	r, err := NewRecorder(Config{Dir: dir}, m, "user@example.com", "w01", "job 1")
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	if err := r.AddFrameAt(0, []byte("not a jpeg")); err != nil {
+		t.Fatalf("AddFrameAt: %v", err)
+	}
+	if _, err := r.Finish(); err == nil {
+		t.Fatalf("Finish with a corrupted frame succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, r.baseName+".avi")); !os.IsNotExist(err) {
+		t.Errorf("The partial video was not removed: %v", err)
+	}
+
+	// The frame is replaced, and Finish is retried.
+	if err := r.AddFrameAt(0, testJPEG(t, 0)); err != nil {
+		t.Fatalf("AddFrameAt: %v", err)
+	}
+	if _, err := r.Finish(); err != nil {
+		t.Fatalf("Finish: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, r.baseName+".avi")); err != nil {
+		t.Errorf("The video was not written: %v", err)
+	}
+}
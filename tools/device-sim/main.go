@@ -0,0 +1,128 @@
+// device-sim simulates a fleet of printers talking to a device API server, for load and integration
+// testing of the cloud side. Every printer prints jobs one after another, reporting the progress,
+// the frame index and the pose, and sending synthetic camera frames. The latencies and errors
+// are reported periodically.
+//
+// For example, against a local mock-cloud:
+//
+//	device-sim -url ws://localhost:8080/device-api/v1 -n 100 -status-interval 500ms
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/logging"
+)
+
+var (
+	server         = flag.String("server", device_api.TestAPIServer, "API server to connect to")
+	url            = flag.String("url", "", "WebSocket URL of the device API. Overrides -server")
+	numPrinters    = flag.Int("n", 10, "The number of simulated printers")
+	user           = flag.String("user", "", "If set, every printer is registered with this user cookie first")
+	cookiePrefix   = flag.String("cookie-prefix", "device-sim", "Without -user, printer i says hello with the cookie <prefix>-<i>")
+	statusInterval = flag.Duration("status-interval", time.Second, "How often every printer reports its status")
+	frameInterval  = flag.Duration("frame-interval", 5*time.Second, "How often every printer sends a camera frame. 0 disables frames")
+	frameSize      = flag.String("frame-size", "320x240", "The size of the synthetic camera frames")
+	layerTime      = flag.Duration("layer-time", 2*time.Second, "How long a layer takes to print")
+	layers         = flag.Int("layers", 100, "The number of layers in a simulated job")
+	ramp           = flag.Duration("ramp", 10*time.Second, "The printers are started evenly over this period")
+	duration       = flag.Duration("duration", 0, "How long to run. 0 means until interrupted")
+	reportInterval = flag.Duration("report", 10*time.Second, "How often to print the stats")
+	reconnectDelay = flag.Duration("reconnect-delay", 5*time.Second, "How long a printer waits before reconnecting")
+	logLevels      = flag.String("log", "warn", "Log levels, like info,device_api=debug")
+)
+
+type config struct {
+	dial           *device_api.DialConfig
+	user           string
+	statusInterval time.Duration
+	frameInterval  time.Duration
+	frameWidth     int
+	frameHeight    int
+	layerTime      time.Duration
+	layers         int
+	reconnectDelay time.Duration
+}
+
+func newConfig() (*config, error) {
+	cfg := &config{
+		dial:           &device_api.DialConfig{Server: *server, URL: *url},
+		user:           *user,
+		statusInterval: *statusInterval,
+		frameInterval:  *frameInterval,
+		layerTime:      *layerTime,
+		layers:         *layers,
+		reconnectDelay: *reconnectDelay,
+	}
+	if _, err := fmt.Sscanf(*frameSize, "%dx%d", &cfg.frameWidth, &cfg.frameHeight); err != nil ||
+		cfg.frameWidth <= 0 || cfg.frameHeight <= 0 {
+		return nil, fmt.Errorf("invalid -frame-size %q, want like 320x240", *frameSize)
+	}
+	if cfg.statusInterval <= 0 || cfg.layerTime <= 0 || cfg.layers <= 0 {
+		return nil, fmt.Errorf("-status-interval, -layer-time and -layers must be positive")
+	}
+	return cfg, nil
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.ParseLevels(*logLevels); err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := newConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	go func() {
+		<-interrupted
+		cancel()
+	}()
+
+	st := newStats()
+	start := time.Now()
+	done := make(chan bool)
+	for i := 0; i < *numPrinters; i++ {
+		cookie := ""
+		if cfg.user == "" {
+			cookie = fmt.Sprintf("%s-%d", *cookiePrefix, i)
+		}
+		delay := *ramp * time.Duration(i) / time.Duration(*numPrinters)
+		go func(p *printer) {
+			defer func() { done <- true }()
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			p.run(ctx, cookie)
+		}(newPrinter(i, cfg, st))
+	}
+
+	ticker := time.NewTicker(*reportInterval)
+	defer ticker.Stop()
+	for running := *numPrinters; running > 0; {
+		select {
+		case <-ticker.C:
+			fmt.Print(st.report(time.Since(start)))
+		case <-done:
+			running--
+		}
+	}
+	fmt.Print(st.report(time.Since(start)))
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/job"
+	"github.com/robodone/robosla-common/pkg/opapi"
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+// The layer height of the simulated jobs, in mm.
+const layerHeight = 0.05
+
+// The number of status messages waiting for an ack, after which they are forgotten.
+const maxUnacked = 1000
+
+// printer simulates a single device: it prints jobs one after another, reports the progress
+// and sends camera frames.
+type printer struct {
+	id    int
+	cfg   *config
+	stats *stats
+	// Held while sending the job events, so that they are sent in order.
+	sendMu sync.Mutex
+
+	mu sync.Mutex
+	// The client of the current session.
+	c        *device_api.Client
+	jobName  string
+	jobs     int
+	layer    int
+	layers   int
+	started  time.Time
+	paused   bool
+	moving   opapi.MovingState
+	gripper  opapi.GripperState
+	lastStep time.Time
+	// The send times of the status messages waiting for an ack, by ID.
+	sent   map[string]time.Time
+	msgCnt int
+	// The job events to send, once mu is released.
+	events []*job.Event
+}
+
+func newPrinter(id int, cfg *config, st *stats) *printer {
+	return &printer{
+		id:      id,
+		cfg:     cfg,
+		stats:   st,
+		moving:  opapi.MovingStateIdle,
+		gripper: opapi.GripperStateOpen,
+		sent:    make(map[string]time.Time),
+	}
+}
+
+// run connects and simulates the printer until ctx is done, reconnecting after failures.
+// The failures are counted by session.
+func (p *printer) run(ctx context.Context, cookie string) {
+	for {
+		p.session(ctx, &cookie)
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.cfg.reconnectDelay):
+		}
+		p.stats.add("reconnects", 1)
+	}
+}
+
+// session runs a single connection. If cookie is empty, the device is registered first.
+// Every failure is counted once, by its kind.
+func (p *printer) session(ctx context.Context, cookie *string) error {
+	conn, err := device_api.Dial(p.cfg.dial)
+	if err != nil {
+		p.stats.fail("dial", err)
+		return err
+	}
+	defer conn.Close()
+	nd := pubsub.NewNode()
+	defer nd.Stop()
+	c := device_api.NewClient(conn, nd)
+	defer c.Stop()
+	c.SetAgentInfo(&device_api.AgentInfo{
+		Version:      "device-sim",
+		OS:           "sim",
+		Arch:         "sim",
+		Capabilities: device_api.DefaultCapabilities,
+	})
+	p.mu.Lock()
+	p.c = c
+	p.mu.Unlock()
+
+	if *cookie == "" {
+		*cookie, err = c.RegisterDevice(p.cfg.user)
+		if err != nil {
+			p.stats.fail("register", err)
+			return err
+		}
+		p.stats.add("registered", 1)
+	}
+	acks, err := nd.SubValue("ack.id")
+	if err != nil {
+		p.stats.fail("session", err)
+		return err
+	}
+	defer acks.Unsub()
+	go p.receiveAcks(acks)
+	p.handleCommands(c)
+
+	start := time.Now()
+	if _, err := c.Hello(*cookie, p.currentJob()); err != nil {
+		p.stats.fail("hello", err)
+		return err
+	}
+	p.stats.hello.add(time.Since(start))
+	p.stats.addOnline(1)
+	defer p.stats.addOnline(-1)
+
+	status := time.NewTicker(p.cfg.statusInterval)
+	defer status.Stop()
+	var frames <-chan time.Time
+	if p.cfg.frameInterval > 0 {
+		t := time.NewTicker(p.cfg.frameInterval)
+		defer t.Stop()
+		frames = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-c.Stopped():
+			err := errors.New("connection closed")
+			p.stats.fail("session", err)
+			return err
+		case <-status.C:
+			p.step()
+			if err := p.sendStatus(c); err != nil {
+				return err
+			}
+		case <-frames:
+			// Old servers don't support binary frames, which is not a reason to reconnect.
+			if err := p.sendFrame(c); err != nil && err != device_api.ErrNotSupported {
+				return err
+			}
+		}
+	}
+}
+
+func (p *printer) receiveAcks(acks *pubsub.ValueSub) {
+	for v := range acks.C() {
+		id, _ := v.(string)
+		p.mu.Lock()
+		sent, ok := p.sent[id]
+		delete(p.sent, id)
+		p.mu.Unlock()
+		if ok {
+			p.stats.ack.add(time.Since(sent))
+		}
+	}
+}
+
+func (p *printer) handleCommands(c *device_api.Client) {
+	ack := func(f func()) device_api.CommandHandler {
+		return func(cmd *device_api.Command) error {
+			p.stats.add("commands "+cmd.Name, 1)
+			p.mu.Lock()
+			f()
+			p.mu.Unlock()
+			p.sendEvents()
+			return nil
+		}
+	}
+	c.HandleCommand(device_api.CmdPause, ack(func() {
+		if p.jobName != "" && !p.paused {
+			p.paused = true
+			p.queueEventLocked(job.EventPaused, "")
+		}
+	}))
+	c.HandleCommand(device_api.CmdResume, ack(func() {
+		if p.paused {
+			p.paused = false
+			p.queueEventLocked(job.EventResumed, "")
+		}
+	}))
+	c.HandleCommand(device_api.CmdCancel, ack(func() {
+		if p.jobName != "" {
+			p.queueEventLocked(job.EventCancelled, "")
+			p.jobName = ""
+			p.moving = opapi.MovingStateIdle
+		}
+	}))
+	c.HandleCommand(device_api.CmdHome, ack(func() { p.moving = opapi.MovingStateHoming }))
+	c.HandleCommand(device_api.CmdSetGripper, func(cmd *device_api.Command) error {
+		return ack(func() { p.gripper = cmd.GripperState })(cmd)
+	})
+	c.HandleCommand(device_api.CmdStartJob, func(cmd *device_api.Command) error {
+		return ack(func() { p.startJobLocked(cmd.JobName) })(cmd)
+	})
+	c.HandleCommand(device_api.CmdRequestCameraFrame, func(cmd *device_api.Command) error {
+		p.stats.add("commands "+cmd.Name, 1)
+		return p.sendFrame(c)
+	})
+}
+
+func (p *printer) currentJob() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jobName
+}
+
+func (p *printer) startJobLocked(name string) {
+	p.jobs++
+	if name == "" {
+		name = fmt.Sprintf("sim-%03d-job-%d", p.id, p.jobs)
+	}
+	p.jobName = name
+	p.layer = 0
+	p.layers = p.cfg.layers
+	p.started = time.Now()
+	p.lastStep = p.started
+	p.paused = false
+	p.moving = opapi.MovingStateMoving
+	p.queueEventLocked(job.EventPrintStarted, "")
+}
+
+// step advances the simulated job according to the time passed.
+func (p *printer) step() {
+	p.mu.Lock()
+	p.stepLocked()
+	p.mu.Unlock()
+	p.sendEvents()
+}
+
+func (p *printer) stepLocked() {
+	now := time.Now()
+	if p.moving == opapi.MovingStateHoming {
+		p.moving = opapi.MovingStateIdle
+	}
+	if p.jobName == "" {
+		p.startJobLocked("")
+		return
+	}
+	if p.paused {
+		p.lastStep = now
+		return
+	}
+	for now.Sub(p.lastStep) >= p.cfg.layerTime && p.layer < p.layers {
+		p.layer++
+		p.lastStep = p.lastStep.Add(p.cfg.layerTime)
+	}
+	if p.layer >= p.layers {
+		p.queueEventLocked(job.EventFinished, "")
+		p.jobName = ""
+		p.moving = opapi.MovingStateIdle
+	}
+}
+
+// queueEventLocked queues a job event for sendEvents, which must be called after releasing mu:
+// sending might block on the connection.
+func (p *printer) queueEventLocked(typ job.EventType, comment string) {
+	p.events = append(p.events, &job.Event{
+		Type:    typ,
+		JobName: p.jobName,
+		TS:      time.Now().UnixNano() / int64(time.Millisecond),
+		Comment: comment,
+	})
+}
+
+func (p *printer) sendEvents() {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	p.mu.Lock()
+	c, events := p.c, p.events
+	p.events = nil
+	p.mu.Unlock()
+	for _, ev := range events {
+		if err := c.NotifyJobEvent(ev); err != nil {
+			p.stats.fail("job event", err)
+			continue
+		}
+		p.stats.add("job events", 1)
+	}
+}
+
+func (p *printer) pose() []float64 {
+	t := time.Since(p.started).Seconds()
+	return []float64{50 + 40*math.Sin(t), 50 + 40*math.Cos(t), float64(p.layer) * layerHeight}
+}
+
+func (p *printer) sendStatus(c *device_api.Client) error {
+	p.mu.Lock()
+	p.msgCnt++
+	msg := &device_api.UplinkMessage{
+		ID:           fmt.Sprintf("sim-%03d-%d-%d", p.id, time.Now().UnixNano(), p.msgCnt),
+		Type:         "progress",
+		JobName:      p.jobName,
+		Success:      true,
+		FrameIndex:   p.layer,
+		NumFrames:    p.layers,
+		MovingState:  p.moving,
+		GripperState: p.gripper,
+	}
+	if p.jobName != "" {
+		msg.Progress = float64(p.layer) / float64(p.layers)
+		msg.Elapsed = time.Since(p.started)
+		msg.Remaining = time.Duration(p.layers-p.layer) * p.cfg.layerTime
+		msg.Pose = p.pose()
+	}
+	if p.paused {
+		msg.MovingState = opapi.MovingStateStopped
+	}
+	if len(p.sent) >= maxUnacked {
+		// The server does not send acks.
+		p.stats.add("unacked notifications", int64(len(p.sent)))
+		p.sent = make(map[string]time.Time)
+	}
+	p.sent[msg.ID] = time.Now()
+	p.mu.Unlock()
+
+	if err := c.Notify(msg); err != nil {
+		p.stats.fail("notify", err)
+		return err
+	}
+	p.stats.add("notifications", 1)
+	return nil
+}
+
+func (p *printer) sendFrame(c *device_api.Client) error {
+	p.mu.Lock()
+	layer, layers := p.layer, p.layers
+	p.mu.Unlock()
+	data, err := syntheticFrame(p.cfg.frameWidth, p.cfg.frameHeight, p.id, layer, layers)
+	if err != nil {
+		return err
+	}
+	err = c.SendCameraFrame(&device_api.CameraFrame{
+		Camera:      "top",
+		TS:          time.Now(),
+		ContentType: "image/jpeg",
+		Data:        data,
+	})
+	if err != nil {
+		p.stats.fail("camera frame", err)
+		return err
+	}
+	p.stats.add("camera frames", 1)
+	p.stats.add("camera bytes", int64(len(data)))
+	return nil
+}
+
+// syntheticFrame draws a gradient with a bar showing the progress of the job.
+func syntheticFrame(width, height, id, layer, layers int) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	done := 0
+	if layers > 0 {
+		done = width * layer / layers
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{R: uint8(x * 255 / width), G: uint8(y * 255 / height), B: uint8(id * 40), A: 255}
+			if y > height*9/10 && x < done {
+				c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 75}); err != nil {
+		return nil, fmt.Errorf("failed to encode a frame: %v", err)
+	}
+	return buf.Bytes(), nil
+}
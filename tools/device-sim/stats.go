@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencies collects the samples of a single metric between two reports.
+type latencies struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	total   int64
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.samples = append(l.samples, d)
+	l.total++
+}
+
+// take returns the samples collected since the last call.
+func (l *latencies) take() (samples []time.Duration, total int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	samples, l.samples = l.samples, nil
+	return samples, l.total
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func (l *latencies) report(name string) string {
+	samples, total := l.take()
+	if len(samples) == 0 {
+		return fmt.Sprintf("%s: none (total %d)", name, total)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	r := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+	return fmt.Sprintf("%s: n=%d p50=%v p90=%v p99=%v max=%v (total %d)", name, len(samples),
+		r(percentile(samples, 0.5)), r(percentile(samples, 0.9)), r(percentile(samples, 0.99)),
+		r(samples[len(samples)-1]), total)
+}
+
+// stats are shared by all simulated printers.
+type stats struct {
+	mu       sync.Mutex
+	online   int
+	counters map[string]int64
+	// The last error of every kind, to show an example in the report.
+	errors map[string]string
+
+	hello latencies
+	ack   latencies
+}
+
+func newStats() *stats {
+	return &stats{counters: make(map[string]int64), errors: make(map[string]string)}
+}
+
+func (s *stats) add(counter string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[counter] += n
+}
+
+func (s *stats) addOnline(delta int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.online += delta
+}
+
+// fail counts the error of the kind, like "hello" or "notify".
+func (s *stats) fail(kind string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counters[kind+" errors"]++
+	s.errors[kind] = err.Error()
+}
+
+func (s *stats) report(elapsed time.Duration) string {
+	var b strings.Builder
+	s.mu.Lock()
+	fmt.Fprintf(&b, "--- %v: %d printers online\n", elapsed.Round(time.Second), s.online)
+	var names []string
+	for name := range s.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %s: %d\n", name, s.counters[name])
+	}
+	var kinds []string
+	for kind := range s.errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		fmt.Fprintf(&b, "  last %s error: %s\n", kind, s.errors[kind])
+	}
+	s.mu.Unlock()
+	fmt.Fprintf(&b, "  %s\n", s.hello.report("hello latency"))
+	fmt.Fprintf(&b, "  %s\n", s.ack.report("notify ack latency"))
+	return b.String()
+}
@@ -0,0 +1,202 @@
+// mock-cloud is a local stand-in for the device API server, to develop and test the agent offline.
+// Users, devices and their state are kept in memory. Point the agent to it with
+//
+//	device_api.DialConfig{URL: "ws://localhost:8080/device-api/v1"}
+//
+// and open http://localhost:8080/ to see the devices and send them commands.
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/job"
+	"github.com/robodone/robosla-common/pkg/logging"
+	"github.com/robodone/robosla-common/pkg/opapi"
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+var (
+	addr      = flag.String("addr", "localhost:8080", "Address to listen on")
+	users     = flag.String("users", "", "Comma-separated user cookies accepted by register-device and pairing. Empty means any")
+	acceptAny = flag.Bool("accept-any", true, "Accept unknown device cookies in hello, creating a new device")
+	tlsCert   = flag.String("tls-cert", "", "TLS certificate file. Plain HTTP, if not set")
+	tlsKey    = flag.String("tls-key", "", "TLS key file")
+	logLevels = flag.String("log", "info", "Log levels, like info,device_api=debug,mock-cloud=warn")
+)
+
+var logger = logging.For("mock-cloud")
+
+const commandTimeout = 30 * time.Second
+
+type cloud struct {
+	st      *store
+	pairing *device_api.MemPairingStore
+	dedup   *device_api.Dedup
+	jobs    *job.Tracker
+}
+
+func (c *cloud) serveDeviceAPI(w http.ResponseWriter, r *http.Request) {
+	conn, err := device_api.UpgradeWS(w, r, nil)
+	if err != nil {
+		logger.Warn("Failed to upgrade a connection", "remoteAddr", r.RemoteAddr, "err", err)
+		return
+	}
+	defer conn.Close()
+	im := &impl{st: c.st}
+	srv := device_api.NewServer(conn, im)
+	im.srv = srv
+	srv.SetPairingStore(c.pairing)
+	srv.SetDedup(c.dedup)
+	srv.SetJobTracker(c.jobs)
+	logger.Info("Device connected", "remoteAddr", r.RemoteAddr)
+	srv.Run()
+	if name := srv.Session().DeviceName; name != "" {
+		c.st.disconnected(name, srv)
+	}
+	logger.Info("Device disconnected", "remoteAddr", r.RemoteAddr, "err", conn.Err())
+}
+
+// serveDevice handles /devices/<name>/frames/<camera>, /devices/<name>/commands and /devices/<name>/files.
+func (c *cloud) serveDevice(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/devices/"), "/")
+	if len(parts) < 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[0]
+	switch {
+	case parts[1] == "frames" && len(parts) == 3:
+		frame, ok := c.st.frame(name, parts[2])
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", frame.ContentType)
+		w.Write(frame.Data)
+	case parts[1] == "commands" && r.Method == http.MethodPost:
+		c.sendCommand(w, r, name)
+	case parts[1] == "files" && r.Method == http.MethodPost:
+		c.sendFile(w, r, name)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *cloud) reportError(w http.ResponseWriter, name string, err error) {
+	c.st.update(name, func(d *device) { d.view.LastError = err.Error() })
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+func (c *cloud) sendCommand(w http.ResponseWriter, r *http.Request, name string) {
+	srv, ok := c.st.server(name)
+	if !ok {
+		http.Error(w, "the device is offline", http.StatusNotFound)
+		return
+	}
+	cmd := &device_api.Command{
+		Name:         r.FormValue("cmd"),
+		JobName:      r.FormValue("job"),
+		Camera:       r.FormValue("camera"),
+		GripperState: opapi.GripperState(r.FormValue("gripper")),
+	}
+	if axes := r.FormValue("axes"); axes != "" {
+		cmd.Axes = strings.Split(axes, ",")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), commandTimeout)
+	defer cancel()
+	if _, err := srv.SendCommand(ctx, cmd); err != nil {
+		c.reportError(w, name, err)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func (c *cloud) sendFile(w http.ResponseWriter, r *http.Request, name string) {
+	srv, ok := c.st.server(name)
+	if !ok {
+		http.Error(w, "the device is offline", http.StatusNotFound)
+		return
+	}
+	fileName := r.URL.Query().Get("name")
+	if fileName == "" {
+		http.Error(w, "name is not set", http.StatusBadRequest)
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the file: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := srv.SendFile(r.Context(), fileName, bytes.NewReader(data), int64(len(data)), nil); err != nil {
+		c.reportError(w, name, err)
+		return
+	}
+	fmt.Fprintf(w, "sent %s (%d bytes) to %s\n", fileName, len(data), name)
+}
+
+func (c *cloud) servePair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST code and user", http.StatusMethodNotAllowed)
+		return
+	}
+	code, user := r.FormValue("code"), r.FormValue("user")
+	if code == "" || !c.st.validUser(user) {
+		http.Error(w, "a pairing code and a known user are required", http.StatusBadRequest)
+		return
+	}
+	if err := c.pairing.Confirm(code, user); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+func main() {
+	flag.Parse()
+	if err := logging.ParseLevels(*logLevels); err != nil {
+		log.Fatal(err)
+	}
+	var userList []string
+	if *users != "" {
+		userList = strings.Split(*users, ",")
+	}
+	mgr := pubsub.NewManager()
+	defer mgr.Stop()
+	c := &cloud{
+		st:      newStore(mgr, userList, *acceptAny),
+		pairing: device_api.NewMemPairingStore(),
+		dedup:   device_api.NewDedup(1000),
+		jobs:    job.NewTracker(),
+	}
+	c.jobs.OnAbandoned = func(deviceName string, m job.Machine) {
+		logger.Warn("Device abandoned a job", "device", deviceName, "job", m.JobName, "state", string(m.State))
+	}
+	sp, err := newStatusPage(mgr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device-api/v1", c.serveDeviceAPI)
+	mux.HandleFunc("/devices/", c.serveDevice)
+	mux.HandleFunc("/pair", c.servePair)
+	mux.HandleFunc("/api/devices", sp.serveJSON)
+	mux.HandleFunc("/", sp.serveHTML)
+
+	logger.Info("Listening", "addr", *addr)
+	if *tlsCert != "" {
+		err = http.ListenAndServeTLS(*addr, *tlsCert, *tlsKey, mux)
+	} else {
+		err = http.ListenAndServe(*addr, mux)
+	}
+	log.Fatal(err)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+// statusPage keeps the latest views of all devices, received from pubsub.Manager.
+type statusPage struct {
+	mu      sync.Mutex
+	devices map[string]*deviceView
+}
+
+func newStatusPage(mgr *pubsub.Manager) (*statusPage, error) {
+	sub, err := mgr.SubAll("device")
+	if err != nil {
+		return nil, fmt.Errorf("failed to subscribe to device updates: %v", err)
+	}
+	sp := &statusPage{devices: make(map[string]*deviceView)}
+	go sp.run(sub)
+	return sp, nil
+}
+
+func (sp *statusPage) run(sub *pubsub.Sub) {
+	for update := range sub.C() {
+		var v struct {
+			Device *deviceView `json:"device"`
+		}
+		if err := json.Unmarshal([]byte(update), &v); err != nil || v.Device == nil {
+			logger.Warn("Unexpected device update", "update", update, "err", err)
+			continue
+		}
+		sp.mu.Lock()
+		sp.devices[v.Device.Name] = v.Device
+		sp.mu.Unlock()
+	}
+}
+
+func (sp *statusPage) list() []*deviceView {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var res []*deviceView
+	for _, d := range sp.devices {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func (sp *statusPage) serveJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sp.list()); err != nil {
+		logger.Warn("Failed to write the device list", "err", err)
+	}
+}
+
+func (sp *statusPage) serveHTML(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTmpl.Execute(w, sp.list()); err != nil {
+		logger.Warn("Failed to render the status page", "err", err)
+	}
+}
+
+var statusTmpl = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(v float64) string { return fmt.Sprintf("%.1f%%", 100*v) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="refresh" content="2">
+<title>mock-cloud</title>
+<style>
+body { font-family: sans-serif; }
+td, th { padding: 4px 8px; text-align: left; vertical-align: top; }
+pre { max-height: 10em; overflow: auto; background: #eee; }
+</style>
+</head>
+<body>
+<h1>Devices</h1>
+<form method="post" action="/pair">
+Pairing code: <input name="code"> User cookie: <input name="user"> <input type="submit" value="Pair">
+</form>
+{{range .}}
+<h2>{{.Name}} {{if .Online}}(online){{else}}(offline){{end}}</h2>
+<table>
+<tr><th>Last seen</th><td>{{.LastSeen.Format "15:04:05"}}</td></tr>
+{{with .Agent}}<tr><th>Agent</th><td>{{.Version}} {{.OS}}/{{.Arch}}</td></tr>{{end}}
+<tr><th>Notifications</th><td>{{.Notifies}}</td></tr>
+{{with .Status}}
+<tr><th>Job</th><td>{{.JobName}} ({{.Type}})</td></tr>
+<tr><th>Progress</th><td>{{percent .Progress}}, frame {{.FrameIndex}} of {{.NumFrames}}, remaining {{.Remaining}}</td></tr>
+<tr><th>State</th><td>{{.MovingState}}, gripper {{.GripperState}}, pose {{.Pose}}</td></tr>
+{{end}}
+{{if .LastError}}<tr><th>Last error</th><td>{{.LastError}}</td></tr>{{end}}
+</table>
+{{$name := .Name}}
+{{range .Cameras}}<img src="/devices/{{$name}}/frames/{{.}}" alt="{{.}}" height="240">{{end}}
+{{if .Terminal}}<pre>{{range .Terminal}}{{.Text}}
+{{end}}</pre>{{end}}
+{{if .Online}}
+<form method="post" action="/devices/{{.Name}}/commands">
+<select name="cmd">
+<option>start-job</option><option>pause</option><option>resume</option><option>cancel</option>
+<option>home</option><option>set-gripper</option><option>request-camera-frame</option>
+</select>
+Job: <input name="job"> Camera: <input name="camera"> Gripper: <input name="gripper">
+<input type="submit" value="Send">
+</form>
+{{end}}
+{{else}}
+<p>No devices yet.</p>
+{{end}}
+</body>
+</html>
+`))
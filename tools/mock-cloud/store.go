@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/pubsub"
+	"github.com/robodone/robosla-common/pkg/terminal"
+)
+
+// The number of terminal lines kept per device.
+const terminalLines = 200
+
+// deviceView is what the status page knows about a device. It's published to the node
+// of the device in pubsub.Manager as {"device": view} on every change.
+type deviceView struct {
+	Name      string                    `json:"name"`
+	Online    bool                      `json:"online"`
+	Agent     *device_api.AgentInfo     `json:"agent,omitempty"`
+	LastSeen  time.Time                 `json:"lastSeen"`
+	Status    *device_api.UplinkMessage `json:"status,omitempty"`
+	Cameras   []string                  `json:"cameras,omitempty"`
+	Notifies  int64                     `json:"notifies"`
+	Terminal  []terminal.Line           `json:"terminal,omitempty"`
+	LastError string                    `json:"lastError,omitempty"`
+}
+
+type device struct {
+	view     deviceView
+	srv      *device_api.Server
+	frames   *device_api.FrameStore
+	terminal *terminal.Buffer
+}
+
+// store keeps the users and the devices in memory.
+type store struct {
+	mgr *pubsub.Manager
+
+	mu sync.Mutex
+	// Accepted user cookies. Nil means any non-empty cookie.
+	users map[string]bool
+	// Device cookie -> device name.
+	cookies map[string]string
+	devices map[string]*device
+	nextID  int
+	// Unknown device cookies are registered on hello.
+	acceptAny bool
+}
+
+func newStore(mgr *pubsub.Manager, users []string, acceptAny bool) *store {
+	st := &store{
+		mgr:       mgr,
+		cookies:   make(map[string]string),
+		devices:   make(map[string]*device),
+		acceptAny: acceptAny,
+	}
+	if len(users) > 0 {
+		st.users = make(map[string]bool)
+		for _, u := range users {
+			st.users[u] = true
+		}
+	}
+	return st
+}
+
+var errBadCookie = errors.New("unknown cookie")
+
+// validUser reports whether the user cookie is accepted.
+func (st *store) validUser(userCookie string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.validUserLocked(userCookie)
+}
+
+func (st *store) validUserLocked(userCookie string) bool {
+	return userCookie != "" && (st.users == nil || st.users[userCookie])
+}
+
+// register creates a device for the user, and returns its cookie.
+func (st *store) register(userCookie string) (cookie string, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.validUserLocked(userCookie) {
+		return "", errBadCookie
+	}
+	name, cookie := st.newDeviceLocked()
+	st.cookies[cookie] = name
+	return cookie, nil
+}
+
+func (st *store) newDeviceLocked() (name, cookie string) {
+	st.nextID++
+	name = fmt.Sprintf("mock-%03d", st.nextID)
+	cookie = fmt.Sprintf("%s-cookie-%d", name, time.Now().UnixNano())
+	return name, cookie
+}
+
+// login returns the name of the device with the cookie.
+func (st *store) login(cookie string) (string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	name, ok := st.cookies[cookie]
+	if ok {
+		return name, nil
+	}
+	if !st.acceptAny || cookie == "" {
+		return "", errBadCookie
+	}
+	name, _ = st.newDeviceLocked()
+	st.cookies[cookie] = name
+	return name, nil
+}
+
+func (st *store) deviceLocked(name string) *device {
+	d, ok := st.devices[name]
+	if !ok {
+		d = &device{
+			view:     deviceView{Name: name},
+			frames:   device_api.NewFrameStore(),
+			terminal: terminal.NewBuffer(terminalLines),
+		}
+		st.devices[name] = d
+	}
+	return d
+}
+
+// update changes the device with fn, and publishes the result.
+func (st *store) update(name string, fn func(d *device)) {
+	st.mu.Lock()
+	d := st.deviceLocked(name)
+	fn(d)
+	d.view.LastSeen = time.Now()
+	d.view.Cameras = d.frames.Cameras()
+	d.view.Terminal = d.terminal.Tail(terminalLines)
+	data, err := json.Marshal(map[string]interface{}{"device": &d.view})
+	st.mu.Unlock()
+	if err != nil {
+		logger.Error("Failed to marshal the state of a device", "device", name, "err", err)
+		return
+	}
+	if err := st.mgr.Pub(name, string(data)); err != nil {
+		logger.Error("Failed to publish the state of a device", "device", name, "err", err)
+	}
+}
+
+func (st *store) connected(name string, srv *device_api.Server) {
+	st.update(name, func(d *device) {
+		d.srv = srv
+		d.view.Online = true
+	})
+}
+
+func (st *store) disconnected(name string, srv *device_api.Server) {
+	st.update(name, func(d *device) {
+		// The device might have already reconnected.
+		if d.srv == srv {
+			d.srv = nil
+			d.view.Online = false
+		}
+	})
+}
+
+// server returns the current connection of the device.
+func (st *store) server(name string) (*device_api.Server, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d, ok := st.devices[name]
+	if !ok || d.srv == nil {
+		return nil, false
+	}
+	return d.srv, true
+}
+
+func (st *store) frame(name, camera string) (*device_api.CameraFrame, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	d, ok := st.devices[name]
+	if !ok {
+		return nil, false
+	}
+	return d.frames.Latest(camera)
+}
+
+// impl serves a single connection.
+type impl struct {
+	st  *store
+	srv *device_api.Server
+}
+
+func (im *impl) RegisterDevice(sess *device_api.Session, userCookie string, resp *device_api.Response) error {
+	cookie, err := im.st.register(userCookie)
+	if err != nil {
+		return err
+	}
+	resp.Login = &device_api.Login{Cookie: cookie}
+	return nil
+}
+
+func (im *impl) Hello(sess *device_api.Session, cookie, jobName string, resp *device_api.Response) error {
+	name, err := im.st.login(cookie)
+	if err != nil {
+		return err
+	}
+	resp.Login = &device_api.Login{DeviceName: name}
+	im.st.connected(name, im.srv)
+	return nil
+}
+
+func (im *impl) Notify(sess *device_api.Session, msg *device_api.UplinkMessage, resp *device_api.Response) error {
+	im.st.update(sess.DeviceName, func(d *device) {
+		d.view.Status = msg
+		d.view.Notifies++
+		// The agent info is not known yet in Hello.
+		d.view.Agent = sess.Agent
+	})
+	return nil
+}
+
+func (im *impl) TerminalOutput(sess *device_api.Session, batch *device_api.TerminalBatch, resp *device_api.Response) error {
+	im.st.update(sess.DeviceName, func(d *device) {
+		d.terminal.Add(batch.Lines...)
+	})
+	return nil
+}
+
+func (im *impl) CameraFrame(sess *device_api.Session, frame *device_api.CameraFrame) error {
+	im.st.update(sess.DeviceName, func(d *device) {
+		d.frames.Put(frame)
+	})
+	return nil
+}
@@ -0,0 +1,127 @@
+// replay-session feeds a session recorded with device_api.RecordingConn back into a Server or a Client,
+// and prints what they send in response next to what was recorded.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robodone/robosla-common/pkg/device_api"
+	"github.com/robodone/robosla-common/pkg/logging"
+	"github.com/robodone/robosla-common/pkg/pubsub"
+)
+
+var (
+	recording = flag.String("recording", "", "Path to the recorded session")
+	target    = flag.String("target", "server", "What to replay the session into: server or client")
+	dir       = flag.String("dir", device_api.DirIn, "The recorded direction to feed: in, if the recording was made on the target side, out otherwise")
+	speed     = flag.Float64("speed", 0, "Replay speed relative to the recording. 0 means as fast as possible")
+	watch     = flag.String("watch", "login,error,pairing", "Comma-separated client state paths to print (-target=client)")
+	grace     = flag.Duration("grace", time.Second, "How long to wait for the responses after the last message")
+	logLevels = flag.String("log", "info", "Log levels, like info,device_api=debug")
+)
+
+// replayImpl accepts everything, and prints the messages from the device.
+type replayImpl struct{}
+
+func (replayImpl) Hello(sess *device_api.Session, cookie, jobName string, resp *device_api.Response) error {
+	resp.Login = &device_api.Login{DeviceName: "replay"}
+	return nil
+}
+
+func (replayImpl) RegisterDevice(sess *device_api.Session, cookie string, resp *device_api.Response) error {
+	resp.Login = &device_api.Login{Cookie: "replay-device-cookie"}
+	return nil
+}
+
+func (replayImpl) Notify(sess *device_api.Session, msg *device_api.UplinkMessage, resp *device_api.Response) error {
+	fmt.Printf("notify: %+v\n", msg)
+	return nil
+}
+
+func replay(msgs []*device_api.RecordedMessage) (*device_api.ReplayConn, error) {
+	conn := device_api.NewReplayConn(msgs, *dir, *speed)
+	switch *target {
+	case "server":
+		srv := device_api.NewServer(conn, replayImpl{})
+		go srv.Run()
+	case "client":
+		nd := pubsub.NewNode()
+		for _, path := range strings.Split(*watch, ",") {
+			path := path
+			ss, err := nd.SubString(path)
+			if err != nil {
+				return nil, err
+			}
+			go func() {
+				for v := range ss.C() {
+					fmt.Printf("state %s: %s\n", path, v)
+				}
+			}()
+		}
+		device_api.NewClient(conn, nd)
+	default:
+		return nil, fmt.Errorf("unknown -target %q, want server or client", *target)
+	}
+	<-conn.Done()
+	time.Sleep(*grace)
+	return conn, conn.Close()
+}
+
+func describe(rm *device_api.RecordedMessage) string {
+	if rm == nil {
+		return "<none>"
+	}
+	if rm.Binary != nil {
+		return fmt.Sprintf("<binary, %d bytes>", len(rm.Binary))
+	}
+	return rm.Text
+}
+
+func main() {
+	flag.Parse()
+	if *recording == "" {
+		log.Fatal(errors.New("-recording is required"))
+	}
+	if err := logging.ParseLevels(*logLevels); err != nil {
+		log.Fatal(err)
+	}
+	msgs, err := device_api.ReadRecordingFile(*recording)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := replay(msgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The responses of the target, to compare with the recorded ones.
+	var want []*device_api.RecordedMessage
+	for _, rm := range msgs {
+		if rm.Dir != *dir {
+			want = append(want, rm)
+		}
+	}
+	got := conn.Sent()
+	diffs := 0
+	for i := 0; i < len(want) || i < len(got); i++ {
+		var w, g *device_api.RecordedMessage
+		if i < len(want) {
+			w = want[i]
+		}
+		if i < len(got) {
+			g = got[i]
+		}
+		if describe(w) == describe(g) {
+			continue
+		}
+		diffs++
+		fmt.Printf("#%d\n  recorded: %s\n  replayed: %s\n", i, describe(w), describe(g))
+	}
+	fmt.Printf("Fed %d messages, %d responses recorded, %d replayed, %d differ\n",
+		len(msgs)-len(want), len(want), len(got), diffs)
+}